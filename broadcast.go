@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// broadcastFetchTimeout bounds loading a chunk for a broadcast group, for the
+// same reason as cacheLoadTimeout.
+const broadcastFetchTimeout = time.Minute
+
+// broadcastMaxLag is how many chunks a listener can fall behind the furthest
+// one in its group before it's dropped from the group to read on its own, so a
+// stalled listener can't hold the group's chunks in memory.
+const broadcastMaxLag = 30
+
+// icyBroadcaster shares chunk audio between ICY listeners hearing the same
+// stream at about the same offset, so each chunk is fetched and demuxed once
+// rather than once per listener. Listeners are grouped by stream and offset to
+// the minute, and each still paces itself with calculateIcySleep.
+type icyBroadcaster struct {
+	store chunkStore
+
+	mu     sync.Mutex
+	groups map[broadcastKey]*broadcastGroup
+}
+
+type broadcastKey struct {
+	streamID string
+	lang     string
+	bucket   time.Duration
+}
+
+// broadcastGroup is the chunks loaded for a set of listeners, and where each
+// of them is up to, or 0 before their first chunk. Chunks before every
+// listener's position are dropped.
+type broadcastGroup struct {
+	subs   map[*icySubscription]int
+	chunks map[int]*broadcastChunk
+}
+
+type broadcastChunk struct {
+	done  chan struct{}
+	audio chunkAudio
+	err   error
+}
+
+func newICYBroadcaster(store chunkStore) *icyBroadcaster {
+	return &icyBroadcaster{
+		store:  store,
+		groups: make(map[broadcastKey]*broadcastGroup),
+	}
+}
+
+// icySubscription is one listener's membership of a broadcast group.
+type icySubscription struct {
+	b   *icyBroadcaster
+	key broadcastKey
+	// dropped is set once the listener fell too far behind the group, after
+	// which it loads its own chunks. Guarded by the broadcaster's lock.
+	dropped bool
+}
+
+// Subscribe joins the group for streamID in lang at offset. The subscription
+// must be closed when the listener goes away.
+func (b *icyBroadcaster) Subscribe(streamID, lang string, offset time.Duration) *icySubscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := broadcastKey{streamID: streamID, lang: lang, bucket: offset.Truncate(time.Minute)}
+	g, ok := b.groups[key]
+	if !ok {
+		g = &broadcastGroup{
+			subs:   make(map[*icySubscription]int),
+			chunks: make(map[int]*broadcastChunk),
+		}
+		b.groups[key] = g
+	}
+	s := &icySubscription{b: b, key: key}
+	g.subs[s] = 0
+	return s
+}
+
+// Close leaves the group, dropping it once nobody is left.
+func (s *icySubscription) Close() {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if s.dropped {
+		return
+	}
+	g := s.b.groups[s.key]
+	delete(g.subs, s)
+	if len(g.subs) == 0 {
+		delete(s.b.groups, s.key)
+		return
+	}
+	g.evict()
+}
+
+// Audio returns the audio for c, loading it if nobody in the group has yet.
+// It also marks c as where this listener is up to.
+func (s *icySubscription) Audio(ctx context.Context, c recordedChunk) (chunkAudio, error) {
+	s.b.mu.Lock()
+	if s.dropped {
+		s.b.mu.Unlock()
+		icyChunkLoadCount.WithLabelValues(s.key.streamID).Inc()
+		return readChunkAudio(ctx, s.b.store, c, s.key.lang)
+	}
+	g := s.b.groups[s.key]
+	g.subs[s] = c.Sequence
+	g.evict()
+	bc, ok := g.chunks[c.Sequence]
+	if !ok {
+		bc = &broadcastChunk{done: make(chan struct{})}
+		g.chunks[c.Sequence] = bc
+		go s.b.load(g, c, s.key.lang, bc)
+		icyChunkLoadCount.WithLabelValues(s.key.streamID).Inc()
+	} else {
+		icyChunkShareCount.WithLabelValues(s.key.streamID).Inc()
+	}
+	s.b.mu.Unlock()
+
+	select {
+	case <-bc.done:
+		return bc.audio, bc.err
+	case <-ctx.Done():
+		return chunkAudio{}, ctx.Err()
+	}
+}
+
+func (b *icyBroadcaster) load(g *broadcastGroup, c recordedChunk, lang string, bc *broadcastChunk) {
+	ctx, cancel := context.WithTimeout(context.Background(), broadcastFetchTimeout)
+	defer cancel()
+
+	bc.audio, bc.err = readChunkAudio(ctx, b.store, c, lang)
+
+	if bc.err != nil {
+		// let the next listener to ask retry it
+		b.mu.Lock()
+		if g.chunks[c.Sequence] == bc {
+			delete(g.chunks, c.Sequence)
+		}
+		b.mu.Unlock()
+	}
+	close(bc.done)
+}
+
+// evict drops listeners more than broadcastMaxLag chunks behind the furthest
+// one, then chunks that every remaining listener has moved past. Must be
+// called with the broadcaster's lock held.
+func (g *broadcastGroup) evict() {
+	highest := 0
+	for _, seq := range g.subs {
+		highest = max(highest, seq)
+	}
+	lowest := -1
+	for s, seq := range g.subs {
+		if seq == 0 {
+			continue
+		}
+		if seq < highest-broadcastMaxLag {
+			s.dropped = true
+			delete(g.subs, s)
+			continue
+		}
+		if lowest == -1 || seq < lowest {
+			lowest = seq
+		}
+	}
+	for seq := range g.chunks {
+		if seq < lowest {
+			delete(g.chunks, seq)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore counts object reads.
+type countingStore struct {
+	chunkStore
+	gets atomic.Int32
+}
+
+func (c *countingStore) GetObjectReader(ctx context.Context, rc recordedChunk) (io.ReadCloser, error) {
+	c.gets.Add(1)
+	return c.chunkStore.GetObjectReader(ctx, rc)
+}
+
+func TestICYBroadcaster(t *testing.T) {
+	ctx := context.Background()
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	for i := range 4 {
+		key := encodeObjectKey("s", t0.Add(time.Duration(i)*10*time.Second), 10, i+1, 0, fmt.Sprintf("chunk-%d.aac", i+1))
+		if err := fs.PutObject(ctx, key, testADTSFrame(byte(i+1), 3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.LoadStream(ctx, "s"); err != nil {
+		t.Fatal(err)
+	}
+	rcs, err := idx.Chunks(ctx, "s", 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &countingStore{chunkStore: fs}
+	b := newICYBroadcaster(store)
+
+	// same minute, same group
+	a := b.Subscribe("s", "", 2*time.Hour+10*time.Second)
+	c := b.Subscribe("s", "", 2*time.Hour+40*time.Second)
+	// different offset, own group
+	other := b.Subscribe("s", "", 3*time.Hour)
+	defer other.Close()
+
+	for _, sub := range []*icySubscription{a, c, other} {
+		audio, err := sub.Audio(ctx, rcs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(audio.frames, testADTSFrame(1, 3)) || audio.contentType != contentTypeAAC {
+			t.Errorf("want aac frame 1, got %x %s", audio.frames, audio.contentType)
+		}
+	}
+	if got := store.gets.Load(); got != 2 {
+		t.Errorf("want one load per group, got %d", got)
+	}
+
+	// once everyone in the group has moved on, the old chunk goes
+	if _, err := a.Audio(ctx, rcs[1]); err != nil {
+		t.Fatal(err)
+	}
+	g := b.groups[a.key]
+	if _, ok := g.chunks[1]; !ok {
+		t.Error("chunk 1 should be kept while c is still on it")
+	}
+	if _, err := c.Audio(ctx, rcs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.chunks[1]; ok {
+		t.Error("chunk 1 should be evicted")
+	}
+
+	a.Close()
+	c.Close()
+	if _, ok := b.groups[a.key]; ok {
+		t.Error("empty group should be dropped")
+	}
+}
+
+func TestICYBroadcasterDropsLaggard(t *testing.T) {
+	ctx := context.Background()
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	n := broadcastMaxLag + 3
+	for i := range n {
+		key := encodeObjectKey("s", t0.Add(time.Duration(i)*10*time.Second), 10, i+1, 0, fmt.Sprintf("chunk-%d.aac", i+1))
+		if err := fs.PutObject(ctx, key, testADTSFrame(byte(i+1), 3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.LoadStream(ctx, "s"); err != nil {
+		t.Fatal(err)
+	}
+	rcs, err := idx.Chunks(ctx, "s", 1, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := newICYBroadcaster(fs)
+	fast := b.Subscribe("s", "", time.Hour)
+	defer fast.Close()
+	slow := b.Subscribe("s", "", time.Hour)
+	defer slow.Close()
+
+	if _, err := slow.Audio(ctx, rcs[0]); err != nil {
+		t.Fatal(err)
+	}
+	g := b.groups[fast.key]
+	for _, rc := range rcs[:broadcastMaxLag+1] {
+		if _, err := fast.Audio(ctx, rc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := g.chunks[1]; !ok {
+		t.Error("chunk 1 should be kept while slow is within reach")
+	}
+
+	// one more and slow is too far behind, so the group stops waiting for it
+	if _, err := fast.Audio(ctx, rcs[broadcastMaxLag+1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.subs[slow]; ok {
+		t.Error("want slow dropped from the group")
+	}
+	if len(g.chunks) != 1 {
+		t.Errorf("want only fast's chunk kept, got %d", len(g.chunks))
+	}
+
+	// and reads on its own from then on
+	audio, err := slow.Audio(ctx, rcs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(audio.frames, testADTSFrame(2, 3)) {
+		t.Errorf("want frame 2, got %x", audio.frames)
+	}
+	if _, ok := g.chunks[2]; ok {
+		t.Error("slow's read shouldn't be kept in the group")
+	}
+}
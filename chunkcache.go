@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	cacheTierMemory = "memory"
+	cacheTierDisk   = "disk"
+
+	// diskCacheExt marks files the disk tier owns, so only they are cleared
+	// on startup.
+	diskCacheExt = ".chunk"
+)
+
+// cacheLoadTimeout bounds loading a chunk in to the cache on a miss. The load
+// is shared, so it can't be cancelled by whichever reader started it.
+const cacheLoadTimeout = time.Minute
+
+var _ chunkStore = (*cachingChunkStore)(nil)
+
+// cachingChunkStore keeps recently read and written chunk bodies in a
+// byte-bounded LRU in front of another store. Chunks pushed out of memory go
+// to an optional disk tier, itself an LRU, before being dropped.
+type cachingChunkStore struct {
+	chunkStore
+
+	// mu guards the LRUs, disk files are read and written outside it. A file
+	// that has gone from under the disk tier is treated as a miss.
+	mu     sync.Mutex
+	memory *byteLRU
+	disk   *byteLRU
+	dir    string
+
+	loadSF singleflight.Group
+}
+
+// byteLRU tracks entries in use order against a byte budget. It only does the
+// bookkeeping, the caller keeps the data.
+type byteLRU struct {
+	max, size int64
+	order     *list.List // front is most recently used
+	entries   map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	size int64
+	// body is only held for the memory tier.
+	body []byte
+}
+
+func newByteLRU(max int64) *byteLRU {
+	return &byteLRU{max: max, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (l *byteLRU) get(key string) (*lruEntry, bool) {
+	e, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruEntry), true
+}
+
+// add inserts an entry, returning those evicted to make room.
+func (l *byteLRU) add(le *lruEntry) []*lruEntry {
+	l.remove(le.key)
+	l.entries[le.key] = l.order.PushFront(le)
+	l.size += le.size
+	var evicted []*lruEntry
+	for l.size > l.max && l.order.Len() > 0 {
+		old := l.order.Back().Value.(*lruEntry)
+		l.remove(old.key)
+		evicted = append(evicted, old)
+	}
+	return evicted
+}
+
+func (l *byteLRU) remove(key string) (*lruEntry, bool) {
+	e, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	le := e.Value.(*lruEntry)
+	l.order.Remove(e)
+	delete(l.entries, key)
+	l.size -= le.size
+	return le, true
+}
+
+// newCachingChunkStore wraps store with a cache of maxBytes in memory, and
+// diskMaxBytes under diskDir if set. Files left in diskDir by a previous run
+// are removed, as there is no index of them.
+func newCachingChunkStore(store chunkStore, maxBytes int64, diskDir string, diskMaxBytes int64) (*cachingChunkStore, error) {
+	c := &cachingChunkStore{
+		chunkStore: store,
+		memory:     newByteLRU(maxBytes),
+	}
+	if diskDir != "" {
+		if err := os.MkdirAll(diskDir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating %s: %w", diskDir, err)
+		}
+		des, err := os.ReadDir(diskDir)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", diskDir, err)
+		}
+		for _, de := range des {
+			if !de.IsDir() && strings.HasSuffix(de.Name(), diskCacheExt) {
+				if err := os.Remove(filepath.Join(diskDir, de.Name())); err != nil {
+					return nil, fmt.Errorf("clearing cache: %w", err)
+				}
+			}
+		}
+		c.dir = diskDir
+		c.disk = newByteLRU(diskMaxBytes)
+	}
+	return c, nil
+}
+
+// Unwrap returns the store the cache is in front of.
+func (c *cachingChunkStore) Unwrap() chunkStore {
+	return c.chunkStore
+}
+
+// GetObjectReader returns the body from the cache, loading it from the
+// underlying store on a miss. Concurrent misses for a chunk share one load.
+func (c *cachingChunkStore) GetObjectReader(ctx context.Context, rc recordedChunk) (io.ReadCloser, error) {
+	if body, ok := c.lookup(rc.ObjectKey); ok {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	chunkCacheMissCount.Inc()
+
+	ch := c.loadSF.DoChan(rc.ObjectKey, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), cacheLoadTimeout)
+		defer cancel()
+		r, err := c.chunkStore.GetObjectReader(ctx, rc)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", rc.ObjectKey, err)
+		}
+		c.insert(rc.ObjectKey, body)
+		return body, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return io.NopCloser(bytes.NewReader(res.Val.([]byte))), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// PutObject writes through to the underlying store, and caches the body as it
+// is likely to be read soon.
+func (c *cachingChunkStore) PutObject(ctx context.Context, objectKey string, body []byte) error {
+	if err := c.chunkStore.PutObject(ctx, objectKey, body); err != nil {
+		return err
+	}
+	c.insert(objectKey, body)
+	return nil
+}
+
+// DeleteObject deletes from the underlying store and the cache.
+func (c *cachingChunkStore) DeleteObject(ctx context.Context, objectKey string) error {
+	c.mu.Lock()
+	c.memory.remove(objectKey)
+	var onDisk bool
+	if c.disk != nil {
+		_, onDisk = c.disk.remove(objectKey)
+	}
+	c.mu.Unlock()
+	if onDisk {
+		os.Remove(c.diskPath(objectKey))
+	}
+	return c.chunkStore.DeleteObject(ctx, objectKey)
+}
+
+func (c *cachingChunkStore) lookup(key string) ([]byte, bool) {
+	c.mu.Lock()
+	if le, ok := c.memory.get(key); ok {
+		c.mu.Unlock()
+		chunkCacheHitCount.WithLabelValues(cacheTierMemory).Inc()
+		return le.body, true
+	}
+	// a disk hit moves back to memory, so take it out of the disk tier
+	// before reading it.
+	var onDisk bool
+	if c.disk != nil {
+		_, onDisk = c.disk.remove(key)
+	}
+	c.mu.Unlock()
+	if !onDisk {
+		return nil, false
+	}
+
+	body, err := os.ReadFile(c.diskPath(key))
+	os.Remove(c.diskPath(key))
+	if err != nil {
+		// treat it as gone
+		return nil, false
+	}
+	chunkCacheHitCount.WithLabelValues(cacheTierDisk).Inc()
+	c.insert(key, body)
+	return body, true
+}
+
+// insert adds a body to the memory tier, moving what it pushes out to disk.
+func (c *cachingChunkStore) insert(key string, body []byte) {
+	c.mu.Lock()
+	evicted := c.memory.add(&lruEntry{key: key, size: int64(len(body)), body: body})
+	c.mu.Unlock()
+	for _, le := range evicted {
+		chunkCacheEvictionCount.WithLabelValues(cacheTierMemory).Inc()
+		if c.disk != nil {
+			c.addDisk(le.key, le.body)
+		}
+	}
+}
+
+// addDisk writes a body to the disk tier, removing the files it pushes out.
+func (c *cachingChunkStore) addDisk(key string, body []byte) {
+	if int64(len(body)) > c.disk.max {
+		return
+	}
+	if err := os.WriteFile(c.diskPath(key), body, 0o644); err != nil {
+		return
+	}
+	c.mu.Lock()
+	evicted := c.disk.add(&lruEntry{key: key, size: int64(len(body))})
+	c.mu.Unlock()
+	for _, le := range evicted {
+		chunkCacheEvictionCount.WithLabelValues(cacheTierDisk).Inc()
+		os.Remove(c.diskPath(le.key))
+	}
+}
+
+func (c *cachingChunkStore) diskPath(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:])+diskCacheExt)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachingChunkStore(t *testing.T) {
+	ctx := context.Background()
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backing := &countingStore{chunkStore: fs}
+
+	diskDir := t.TempDir()
+	// left over from a previous run
+	if err := os.WriteFile(filepath.Join(diskDir, "stale"+diskCacheExt), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(diskDir, "keep.txt"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// room for two 10 byte chunks in memory, and two more on disk
+	c, err := newCachingChunkStore(backing, 20, diskDir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(diskDir, "stale"+diskCacheExt)); !os.IsNotExist(err) {
+		t.Error("stale cache file should be cleared")
+	}
+	if _, err := os.Stat(filepath.Join(diskDir, "keep.txt")); err != nil {
+		t.Error("other files should be left alone")
+	}
+
+	t0 := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	var rcs []recordedChunk
+	for i := range 5 {
+		cid := fmt.Sprintf("chunk-%d.ts", i+1)
+		key := encodeObjectKey("s", t0.Add(time.Duration(i)*10*time.Second), 10, i+1, 0, cid)
+		if err := c.PutObject(ctx, key, fmt.Appendf(nil, "chunk-%04d", i+1)); err != nil {
+			t.Fatal(err)
+		}
+		rcs = append(rcs, recordedChunk{Sequence: i + 1, ChunkID: cid, ObjectKey: key})
+	}
+
+	read := func(rc recordedChunk) string {
+		t.Helper()
+		r, err := c.GetObjectReader(ctx, rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// 4 and 5 are in memory, 2 and 3 on disk, 1 is gone
+	for _, tc := range []struct {
+		seq   int
+		reads int32
+	}{{5, 0}, {4, 0}, {3, 0}, {2, 0}, {1, 1}} {
+		if got := read(rcs[tc.seq-1]); got != fmt.Sprintf("chunk-%04d", tc.seq) {
+			t.Errorf("chunk %d: got %q", tc.seq, got)
+		}
+		if got := backing.gets.Swap(0); got != tc.reads {
+			t.Errorf("chunk %d: want %d backing reads, got %d", tc.seq, tc.reads, got)
+		}
+	}
+
+	if err := c.DeleteObject(ctx, rcs[0].ObjectKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetObjectReader(ctx, rcs[0]); err == nil {
+		t.Error("deleted chunk should not be served from the cache")
+	}
+}
+
+// blockingStore holds reads until release is closed, noting if the read was
+// cancelled in the meantime.
+type blockingStore struct {
+	chunkStore
+	started  chan struct{}
+	release  chan struct{}
+	canceled atomic.Bool
+}
+
+func (b *blockingStore) GetObjectReader(ctx context.Context, rc recordedChunk) (io.ReadCloser, error) {
+	close(b.started)
+	<-b.release
+	b.canceled.Store(ctx.Err() != nil)
+	return io.NopCloser(strings.NewReader("body")), nil
+}
+
+func TestCachingChunkStoreSharedLoad(t *testing.T) {
+	bs := &blockingStore{started: make(chan struct{}), release: make(chan struct{})}
+	c, err := newCachingChunkStore(bs, 100, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := recordedChunk{ObjectKey: "s/chunk"}
+
+	// the reader that starts the load goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error)
+	go func() {
+		_, err := c.GetObjectReader(ctx, rc)
+		errC <- err
+	}()
+	<-bs.started
+	cancel()
+	if err := <-errC; !errors.Is(err, context.Canceled) {
+		t.Errorf("want the reader cancelled, got %v", err)
+	}
+
+	// but the load carries on for the others waiting on it
+	close(bs.release)
+	r, err := c.GetObjectReader(context.Background(), rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "body" {
+		t.Errorf("want body, got %q", b)
+	}
+	if bs.canceled.Load() {
+		t.Error("want the shared load not cancelled with its first reader")
+	}
+}
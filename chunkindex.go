@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -16,6 +18,15 @@ type recordedChunk struct {
 	Duration  float64
 	FetchedAt time.Time
 	ObjectKey string
+	// Size of the object in bytes, 0 if unknown.
+	Size int64
+	// Title is the EXTINF title from the source playlist, often what is
+	// playing. It is only held in memory, so is lost on restart.
+	Title string
+	// Discontinuity is set when the chunk doesn't follow on from the one
+	// recorded before it, because segments were missed or the source marked
+	// one.
+	Discontinuity bool
 }
 
 // chunkIndex holds per-stream segment metadata in memory. It is rebuilt from S3
@@ -26,15 +37,48 @@ type chunkIndex struct {
 	streams map[string][]recordedChunk
 	// stream id -> set of logical chunk ids (URL basename) already stored
 	logical map[string]map[string]struct{}
+	// stream id -> variants recorded as sub-streams, highest bandwidth first
+	variants map[string][]streamVariant
+	// stream id -> the variant sub-stream reads of the stream itself go to
+	primary map[string]string
 }
 
 func newChunkIndex() *chunkIndex {
 	return &chunkIndex{
-		streams: make(map[string][]recordedChunk),
-		logical: make(map[string]map[string]struct{}),
+		streams:  make(map[string][]recordedChunk),
+		logical:  make(map[string]map[string]struct{}),
+		variants: make(map[string][]streamVariant),
+		primary:  make(map[string]string),
 	}
 }
 
+// resolve returns the chunks reads of streamID should use. A stream that
+// records variants reads its primary variant. Variants are read with the
+// chunks the stream recorded before they started in front of them, so what
+// was recorded before turning on variants can still be played. Callers must
+// hold the lock, and mustn't modify the result.
+func (c *chunkIndex) resolve(streamID string) []recordedChunk {
+	base, _, sub := strings.Cut(streamID, "/")
+	if p, ok := c.primary[streamID]; ok {
+		streamID, sub = p, true
+	}
+	ch := c.streams[streamID]
+	if !sub || len(ch) == 0 {
+		return ch
+	}
+	before := c.streams[base]
+	n := sort.Search(len(before), func(i int) bool {
+		return !before[i].FetchedAt.Before(ch[0].FetchedAt) || before[i].Sequence >= ch[0].Sequence
+	})
+	if n == 0 {
+		return ch
+	}
+	out := slices.Concat(before[:n], ch)
+	// the variant doesn't follow on from what the stream recorded
+	out[n].Discontinuity = true
+	return out
+}
+
 func (c *chunkIndex) ensureStream(streamID string) {
 	if c.logical[streamID] == nil {
 		c.logical[streamID] = make(map[string]struct{})
@@ -72,7 +116,7 @@ func (c *chunkIndex) HasLogical(streamID, logicalChunkID string) bool {
 func (c *chunkIndex) GetChunk(streamID, logicalChunkID string) (recordedChunk, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	ch := c.streams[streamID]
+	ch := c.resolve(streamID)
 	for _, rc := range ch {
 		if rc.ChunkID == logicalChunkID {
 			return rc, true
@@ -81,11 +125,16 @@ func (c *chunkIndex) GetChunk(streamID, logicalChunkID string) (recordedChunk, b
 	return recordedChunk{}, false
 }
 
-// NextSequence returns the next sequence number for a new chunk (1-based).
+// NextSequence returns the next sequence number for a new chunk (1-based). A
+// new variant carries on from its stream, so it can be read after it.
 func (c *chunkIndex) NextSequence(streamID string) int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	ch := c.streams[streamID]
+	if len(ch) == 0 {
+		base, _, _ := strings.Cut(streamID, "/")
+		ch = c.streams[base]
+	}
 	if len(ch) == 0 {
 		return 1
 	}
@@ -110,7 +159,7 @@ func (c *chunkIndex) Append(streamID string, rc recordedChunk) {
 func (c *chunkIndex) SequenceFor(_ context.Context, streamID string, before time.Time) (int, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	ch := c.streams[streamID]
+	ch := c.resolve(streamID)
 	if len(ch) == 0 {
 		return -1, fmt.Errorf("no chunks for stream %s", streamID)
 	}
@@ -127,7 +176,7 @@ func (c *chunkIndex) SequenceFor(_ context.Context, streamID string, before time
 func (c *chunkIndex) Chunks(_ context.Context, streamID string, startSequence int, num int) ([]recordedChunk, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	ch := c.streams[streamID]
+	ch := c.resolve(streamID)
 	var out []recordedChunk
 	for _, rc := range ch {
 		if rc.Sequence < startSequence {
@@ -141,6 +190,105 @@ func (c *chunkIndex) Chunks(_ context.Context, streamID string, startSequence in
 	return out, nil
 }
 
+// ChunksBetween returns the chunks that overlap [from, to), in order.
+func (c *chunkIndex) ChunksBetween(streamID string, from, to time.Time) []recordedChunk {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var out []recordedChunk
+	for _, rc := range c.resolve(streamID) {
+		end := rc.FetchedAt.Add(time.Duration(rc.Duration * float64(time.Second)))
+		if !end.After(from) || !rc.FetchedAt.Before(to) {
+			continue
+		}
+		out = append(out, rc)
+	}
+	return out
+}
+
+// Span returns the start of the oldest chunk and the end of the newest chunk
+// held for a stream. ok is false if there are none.
+func (c *chunkIndex) Span(streamID string) (oldest, newest time.Time, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ch := c.resolve(streamID)
+	if len(ch) == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	last := ch[len(ch)-1]
+	return ch[0].FetchedAt, last.FetchedAt.Add(time.Duration(last.Duration * float64(time.Second))), true
+}
+
+// ChunkAt returns the chunk of a stream starting closest to at, if one starts
+// within tolerance of it. It's used to line variants up with each other.
+func (c *chunkIndex) ChunkAt(streamID string, at time.Time, tolerance time.Duration) (recordedChunk, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ch := c.resolve(streamID)
+	i := sort.Search(len(ch), func(i int) bool { return !ch[i].FetchedAt.Before(at.Add(-tolerance)) })
+	var (
+		best recordedChunk
+		ok   bool
+	)
+	for ; i < len(ch) && !ch[i].FetchedAt.After(at.Add(tolerance)); i++ {
+		if !ok || ch[i].FetchedAt.Sub(at).Abs() < best.FetchedAt.Sub(at).Abs() {
+			best, ok = ch[i], true
+		}
+	}
+	return best, ok
+}
+
+// SetVariants records the variants of a stream being recorded as sub-streams.
+// The first time a stream gets variants, the highest bandwidth one becomes
+// its primary, which reads of the stream itself go to. It stays pinned after
+// that, as sessions hold sequences from it, unless it is no longer recorded.
+func (c *chunkIndex) SetVariants(streamID string, vs []streamVariant) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	vs = slices.Clone(vs)
+	slices.SortStableFunc(vs, func(a, b streamVariant) int { return b.Bandwidth - a.Bandwidth })
+	c.variants[streamID] = vs
+	if len(vs) == 0 {
+		delete(c.primary, streamID)
+		return
+	}
+	p, ok := c.primary[streamID]
+	if !ok || !slices.ContainsFunc(vs, func(v streamVariant) bool { return v.ID == p }) {
+		c.primary[streamID] = vs[0].ID
+	}
+}
+
+// Variants returns the variants recorded for a stream, highest bandwidth
+// first. It's empty if the stream doesn't record them.
+func (c *chunkIndex) Variants(streamID string) []streamVariant {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.variants[streamID])
+}
+
+// Streams returns the ids of every stream in the index, sub-streams included.
+func (c *chunkIndex) Streams() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := slices.Collect(maps.Keys(c.streams))
+	sort.Strings(out)
+	return out
+}
+
+// SubStreams returns the ids of the streams held under streamID, e.g. its
+// variants, including any it no longer records.
+func (c *chunkIndex) SubStreams(streamID string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var out []string
+	for id := range c.streams {
+		if strings.HasPrefix(id, streamID+"/") {
+			out = append(out, id)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
 // RecordChunk appends metadata (tests; production writes via S3 then Append).
 func (c *chunkIndex) RecordChunk(_ context.Context, streamID, chunkID string, duration float64, fetchedAt time.Time) error {
 	if streamID == "" || chunkID == "" {
@@ -154,7 +302,7 @@ func (c *chunkIndex) RecordChunk(_ context.Context, streamID, chunkID string, du
 	if len(ch) > 0 {
 		seq = ch[len(ch)-1].Sequence + 1
 	}
-	key := encodeObjectKey(streamID, fetchedAt.UTC(), duration, chunkID)
+	key := encodeObjectKey(streamID, fetchedAt.UTC(), duration, seq, 0, chunkID)
 	rc := recordedChunk{
 		Sequence:  seq,
 		ChunkID:   chunkID,
@@ -167,6 +315,57 @@ func (c *chunkIndex) RecordChunk(_ context.Context, streamID, chunkID string, du
 	return nil
 }
 
+// timelineGap is a point where a stream's recording doesn't follow on.
+type timelineGap struct {
+	// Sequence is the first chunk after the gap.
+	Sequence int
+	At       time.Time
+	// Missing is the time between the end of the chunk before and the start
+	// of this one. It's 0 for a discontinuity in the source with no hole.
+	Missing time.Duration
+}
+
+// Gaps returns the gaps and discontinuities in the chunks held for a stream,
+// oldest first.
+func (c *chunkIndex) Gaps(streamID string) []timelineGap {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var out []timelineGap
+	ch := c.resolve(streamID)
+	for i := 1; i < len(ch); i++ {
+		if !ch[i].Discontinuity {
+			continue
+		}
+		out = append(out, timelineGap{
+			Sequence: ch[i].Sequence,
+			At:       ch[i].FetchedAt,
+			Missing:  gapBetween(ch[i-1], ch[i]),
+		})
+	}
+	return out
+}
+
+// DiscontinuitiesBetween returns the chunks of a stream marked as following a
+// discontinuity, with sequences from from up to but not including to.
+func (c *chunkIndex) DiscontinuitiesBetween(streamID string, from, to int) []recordedChunk {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var out []recordedChunk
+	for _, rc := range c.resolve(streamID) {
+		if rc.Discontinuity && rc.Sequence >= from && rc.Sequence < to {
+			out = append(out, rc)
+		}
+	}
+	return out
+}
+
+// gapBetween is how much time isn't covered between the end of prev and the
+// start of rc.
+func gapBetween(prev, rc recordedChunk) time.Duration {
+	end := prev.FetchedAt.Add(time.Duration(prev.Duration * float64(time.Second)))
+	return max(rc.FetchedAt.Sub(end), 0)
+}
+
 // LastFetchedByStream returns the newest FetchedAt per stream (for metrics).
 func (c *chunkIndex) LastFetchedByStream() map[string]time.Time {
 	c.mu.RLock()
@@ -187,24 +386,49 @@ func (c *chunkIndex) LastFetchedByStream() map[string]time.Time {
 	return out
 }
 
-// ExpiredChunks returns chunks with FetchedAt before cutoff (oldest first globally), at most limit.
-func (c *chunkIndex) ExpiredChunks(cutoff time.Time, limit int) []recordedChunk {
+// ExpiredStreamChunks returns the chunks of a stream and its sub-streams that
+// fall outside its retention, oldest first and at most limit. The sub-streams
+// share the retention, so they expire the same stretch of time: everything
+// fetched before cutoff, then the oldest remaining stretch until their total
+// size is within maxBytes (if maxBytes > 0). A chunk expires with those
+// starting within half its duration of it, so variants lined up with each
+// other go together.
+func (c *chunkIndex) ExpiredStreamChunks(streamID string, cutoff time.Time, maxBytes int64, limit int) []recordedChunk {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	cutoff = cutoff.UTC()
 	var all []recordedChunk
-	for _, ch := range c.streams {
+	var total int64
+	for id, ch := range c.streams {
+		if id != streamID && !strings.HasPrefix(id, streamID+"/") {
+			continue
+		}
 		for _, rc := range ch {
-			if rc.FetchedAt.Before(cutoff) {
-				all = append(all, rc)
-			}
+			all = append(all, rc)
+			total += rc.Size
 		}
 	}
-	sort.Slice(all, func(i, j int) bool { return all[i].FetchedAt.Before(all[j].FetchedAt) })
-	if len(all) > limit {
-		all = all[:limit]
+	slices.SortStableFunc(all, func(a, b recordedChunk) int {
+		if n := a.FetchedAt.Compare(b.FetchedAt); n != 0 {
+			return n
+		}
+		return strings.Compare(a.ObjectKey, b.ObjectKey)
+	})
+
+	until := cutoff.UTC()
+	var n int
+	for n < len(all) {
+		rc := all[n]
+		if rc.FetchedAt.Before(until) {
+			total -= rc.Size
+			n++
+			continue
+		}
+		if maxBytes <= 0 || total <= maxBytes {
+			break
+		}
+		until = rc.FetchedAt.Add(max(time.Duration(rc.Duration*float64(time.Second))/2, 1))
 	}
-	return all
+	return all[:min(n, limit)]
 }
 
 // Remove removes a chunk from the index (after object delete).
@@ -234,7 +458,7 @@ func (c *chunkIndex) Remove(rc recordedChunk) {
 }
 
 func streamIDFromObjectKey(objectKey string) string {
-	i := strings.IndexByte(objectKey, '/')
+	i := strings.LastIndexByte(objectKey, '/')
 	if i <= 0 {
 		return ""
 	}
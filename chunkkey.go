@@ -3,50 +3,108 @@ package main
 import (
 	"encoding/base64"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// objectKeyVersion marks the current key format, which carries the HLS media
+// sequence and chunk flags. v2 keys have the sequence but no flags. Keys written
+// before either existed have no version field, and decode with sequence 0.
+const (
+	objectKeyVersion   = "v3"
+	objectKeyVersionV2 = "v2"
+)
+
+// chunkFlags are bits stored with a chunk in its key.
+type chunkFlags int
+
+const (
+	// chunkFlagDiscontinuity marks a chunk that doesn't follow on from the one
+	// recorded before it, see recordedChunk.Discontinuity.
+	chunkFlagDiscontinuity chunkFlags = 1 << iota
+	// chunkFlagBroadcastTime marks a key whose time is when the chunk started
+	// in the broadcast, rather than when it was uploaded, so it's expected
+	// to differ from LastModified.
+	chunkFlagBroadcastTime
+)
+
 // encodeObjectKey builds the S3 object key. ts should be UTC (e.g. time.Now().UTC()).
 // The fixed-width Unix nanoseconds segment sorts lexicographically in time order.
-// HLS MEDIA-SEQUENCE lives only in recordedChunk.Sequence, not in the key.
-func encodeObjectKey(streamID string, ts time.Time, durationSec float64, chunkID string) string {
+// The sequence is stored so MEDIA-SEQUENCE survives an index rebuild unchanged.
+func encodeObjectKey(streamID string, ts time.Time, durationSec float64, sequence int, flags chunkFlags, chunkID string) string {
 	ts = ts.UTC()
 	durMs := int(durationSec*1000 + 0.5)
 	enc := base64.RawURLEncoding.EncodeToString([]byte(chunkID))
 	// 19 digits fits int64 Unix nanoseconds; lexicographic order = time order.
-	return fmt.Sprintf("%s/%019d__d%d__%s", streamID, ts.UnixNano(), durMs, enc)
+	return fmt.Sprintf("%s/%019d__%s__d%d__s%d__f%d__%s", streamID, ts.UnixNano(), objectKeyVersion, durMs, sequence, flags, enc)
 }
 
-func decodeObjectKey(key string) (streamID string, keyTime time.Time, durationSec float64, chunkID string, err error) {
-	i := strings.IndexByte(key, '/')
+// decodeObjectKey parses keys from encodeObjectKey. Keys in the original
+// format (without a version or sequence) return a sequence of 0, and keys
+// without flags return none.
+func decodeObjectKey(key string) (streamID string, keyTime time.Time, durationSec float64, sequence int, flags chunkFlags, chunkID string, err error) {
+	// stream ids can have a variant after a /, chunk ids are encoded so never
+	// have one.
+	i := strings.LastIndexByte(key, '/')
 	if i <= 0 || i >= len(key)-1 {
-		return "", time.Time{}, 0, "", fmt.Errorf("invalid key %q", key)
+		return "", time.Time{}, 0, 0, 0, "", fmt.Errorf("invalid key %q", key)
 	}
 	streamID = key[:i]
 	suffix := key[i+1:]
+	// the encoded chunk id may itself contain "__", so it is always the
+	// remainder after the fixed fields.
 	parts := strings.SplitN(suffix, "__", 3)
 	if len(parts) != 3 {
-		return "", time.Time{}, 0, "", fmt.Errorf("invalid key suffix in %q", key)
+		return "", time.Time{}, 0, 0, 0, "", fmt.Errorf("invalid key suffix in %q", key)
+	}
+	if parts[1] == objectKeyVersion || parts[1] == objectKeyVersionV2 {
+		n := 5
+		if parts[1] == objectKeyVersion {
+			n = 6
+		}
+		parts = strings.SplitN(suffix, "__", n)
+		if len(parts) != n {
+			return "", time.Time{}, 0, 0, 0, "", fmt.Errorf("invalid key suffix in %q", key)
+		}
+		if n == 6 {
+			if len(parts[4]) < 2 || parts[4][0] != 'f' {
+				return "", time.Time{}, 0, 0, 0, "", fmt.Errorf("flags marker in %q", key)
+			}
+			f, err := strconv.Atoi(parts[4][1:])
+			if err != nil {
+				return "", time.Time{}, 0, 0, 0, "", fmt.Errorf("flags in %q: %w", key, err)
+			}
+			flags = chunkFlags(f)
+			parts = slices.Delete(parts, 4, 5)
+		}
+		if len(parts[3]) < 2 || parts[3][0] != 's' {
+			return "", time.Time{}, 0, 0, 0, "", fmt.Errorf("sequence marker in %q", key)
+		}
+		sequence, err = strconv.Atoi(parts[3][1:])
+		if err != nil {
+			return "", time.Time{}, 0, 0, 0, "", fmt.Errorf("sequence in %q: %w", key, err)
+		}
+		parts = []string{parts[0], parts[2], parts[4]}
 	}
 	nano, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
-		return "", time.Time{}, 0, "", fmt.Errorf("timestamp in %q: %w", key, err)
+		return "", time.Time{}, 0, 0, 0, "", fmt.Errorf("timestamp in %q: %w", key, err)
 	}
 	if len(parts[1]) < 2 || parts[1][0] != 'd' {
-		return "", time.Time{}, 0, "", fmt.Errorf("duration marker in %q", key)
+		return "", time.Time{}, 0, 0, 0, "", fmt.Errorf("duration marker in %q", key)
 	}
 	durMs, err := strconv.Atoi(parts[1][1:])
 	if err != nil {
-		return "", time.Time{}, 0, "", fmt.Errorf("duration in %q: %w", key, err)
+		return "", time.Time{}, 0, 0, 0, "", fmt.Errorf("duration in %q: %w", key, err)
 	}
 	b, err := base64.RawURLEncoding.DecodeString(parts[2])
 	if err != nil {
-		return "", time.Time{}, 0, "", fmt.Errorf("chunk id encoding in %q: %w", key, err)
+		return "", time.Time{}, 0, 0, 0, "", fmt.Errorf("chunk id encoding in %q: %w", key, err)
 	}
 	chunkID = string(b)
 	durationSec = float64(durMs) / 1000.0
 	keyTime = time.Unix(0, nano).UTC()
-	return streamID, keyTime, durationSec, chunkID, nil
+	return streamID, keyTime, durationSec, sequence, flags, chunkID, nil
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/base64"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -9,11 +12,12 @@ func TestChunkKeyRoundTrip(t *testing.T) {
 	const (
 		stream = "doublej"
 		dur    = 6.006
+		seq    = 163172864
 		cid    = "segment-001.ts"
 	)
 	ts := time.Date(2026, 4, 7, 12, 30, 45, 123456789, time.UTC)
-	key := encodeObjectKey(stream, ts, dur, cid)
-	gotStream, gotTime, gotDur, gotCID, err := decodeObjectKey(key)
+	key := encodeObjectKey(stream, ts, dur, seq, chunkFlagDiscontinuity, cid)
+	gotStream, gotTime, gotDur, gotSeq, gotFlags, gotCID, err := decodeObjectKey(key)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -26,4 +30,50 @@ func TestChunkKeyRoundTrip(t *testing.T) {
 	if gotDur < dur-0.001 || gotDur > dur+0.001 {
 		t.Fatalf("duration: want ~%v got %v", dur, gotDur)
 	}
+	if gotSeq != seq {
+		t.Fatalf("sequence: want %d got %d", seq, gotSeq)
+	}
+	if gotFlags != chunkFlagDiscontinuity {
+		t.Fatalf("flags: want %d got %d", chunkFlagDiscontinuity, gotFlags)
+	}
+}
+
+func TestChunkKeyV2(t *testing.T) {
+	// keys written before flags were stored.
+	ts := time.Date(2026, 4, 7, 12, 30, 45, 123456789, time.UTC)
+	key := fmt.Sprintf("doublej/%019d__v2__d6006__s42__%s", ts.UnixNano(), base64.RawURLEncoding.EncodeToString([]byte("a.ts")))
+	gotStream, gotTime, gotDur, gotSeq, gotFlags, gotCID, err := decodeObjectKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStream != "doublej" || gotCID != "a.ts" || !gotTime.Equal(ts) || gotDur != 6.006 || gotSeq != 42 {
+		t.Fatalf("decode mismatch: %s %q %v %v %d", gotStream, gotCID, gotTime, gotDur, gotSeq)
+	}
+	if gotFlags != 0 {
+		t.Fatalf("v2 keys should decode with no flags, got %d", gotFlags)
+	}
+}
+
+func TestChunkKeyLegacy(t *testing.T) {
+	// keys written before sequences were stored. The chunk id encodes to
+	// something containing "__", to make sure it isn't split.
+	const cid = "seg\xff\xff\xff.ts"
+	ts := time.Date(2026, 4, 7, 12, 30, 45, 123456789, time.UTC)
+	key := fmt.Sprintf("doublej/%019d__d6006__%s", ts.UnixNano(), base64.RawURLEncoding.EncodeToString([]byte(cid)))
+	if !strings.Contains(key[strings.LastIndex(key, "d6006"):], "____") {
+		t.Fatalf("test key %s should contain an encoded __", key)
+	}
+	gotStream, gotTime, gotDur, gotSeq, _, gotCID, err := decodeObjectKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStream != "doublej" || gotCID != cid {
+		t.Fatalf("decode mismatch: %s %q", gotStream, gotCID)
+	}
+	if !gotTime.Equal(ts) || gotDur != 6.006 {
+		t.Fatalf("want %v 6.006, got %v %v", ts, gotTime, gotDur)
+	}
+	if gotSeq != 0 {
+		t.Fatalf("legacy keys should decode with sequence 0, got %d", gotSeq)
+	}
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+const (
+	chunkServingRedirect = "redirect"
+	chunkServingProxy    = "proxy"
+)
+
+// chunkContentTypes maps segment extensions to what players expect.
+var chunkContentTypes = map[string]string{
+	".ts":  "video/mp2t",
+	".aac": "audio/aac",
+	".mp3": "audio/mpeg",
+	".m4s": "audio/mp4",
+	".mp4": "audio/mp4",
+}
+
+// serveChunkContent serves a chunk body from tjts with a content type and an
+// ETag, handling Range and conditional requests.
+func serveChunkContent(w http.ResponseWriter, r *http.Request, rc recordedChunk, modtime time.Time, content io.ReadSeeker) {
+	if ct, ok := chunkContentTypes[filepath.Ext(rc.ChunkID)]; ok {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("ETag", chunkETag(rc))
+	http.ServeContent(w, r, rc.ChunkID, modtime, content)
+}
+
+// chunkETag is derived from the object key. Objects are never rewritten under
+// the same key, so it identifies the content.
+func chunkETag(rc recordedChunk) string {
+	h := sha256.Sum256([]byte(rc.ObjectKey))
+	return `"` + hex.EncodeToString(h[:16]) + `"`
+}
+
+// proxyChunkStore serves chunks through tjts rather than redirecting to the
+// backing store, for when listeners can't reach it. Bodies are read with
+// GetObjectReader, so a cache underneath is used.
+type proxyChunkStore struct {
+	chunkStore
+}
+
+var _ chunkStore = (*proxyChunkStore)(nil)
+
+func newProxyChunkStore(store chunkStore) *proxyChunkStore {
+	return &proxyChunkStore{chunkStore: store}
+}
+
+// Unwrap returns the store chunks are proxied from.
+func (p *proxyChunkStore) Unwrap() chunkStore {
+	return p.chunkStore
+}
+
+// ServeChunk reads the chunk and serves it directly.
+func (p *proxyChunkStore) ServeChunk(w http.ResponseWriter, r *http.Request, rc recordedChunk) error {
+	cr, err := p.GetObjectReader(r.Context(), rc)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	// chunks are small, and ServeContent needs to seek for ranges.
+	body, err := io.ReadAll(cr)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", rc.ObjectKey, err)
+	}
+	serveChunkContent(w, r, rc, rc.FetchedAt, bytes.NewReader(body))
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxyChunkStore(t *testing.T) {
+	ctx := context.Background()
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	rc := recordedChunk{Sequence: 1, ChunkID: "chunk-1.ts", FetchedAt: t0, ObjectKey: encodeObjectKey("s", t0, 10, 1, 0, "chunk-1.ts")}
+	if err := fs.PutObject(ctx, rc.ObjectKey, []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	backing := &countingStore{chunkStore: fs}
+	cache, err := newCachingChunkStore(backing, 1024, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newProxyChunkStore(cache)
+
+	serve := func(hdr http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/chunk", nil)
+		req.Header = hdr
+		rec := httptest.NewRecorder()
+		if err := p.ServeChunk(rec, req, rc); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	rec := serve(http.Header{})
+	if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" {
+		t.Fatalf("want full body, got %d %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "video/mp2t" {
+		t.Errorf("want video/mp2t, got %q", got)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("want an etag")
+	}
+
+	rec = serve(http.Header{"Range": {"bytes=2-4"}})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+		t.Errorf("want partial 234, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(http.Header{"If-None-Match": {etag}})
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("want 304, got %d", rec.Code)
+	}
+
+	if got := backing.gets.Load(); got != 1 {
+		t.Errorf("want reads to come from the cache after the first, got %d backing reads", got)
+	}
+}
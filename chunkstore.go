@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// chunkStore persists recorded segments. The in-memory chunkIndex is the source
+// of truth while running; a store only has to be able to rebuild it on startup.
+type chunkStore interface {
+	// LoadStream lists existing objects for a stream and rebuilds the in-memory index.
+	LoadStream(ctx context.Context, streamID string) error
+	// PutObject stores a segment body under objectKey.
+	PutObject(ctx context.Context, objectKey string, body []byte) error
+	// GetObjectReader streams an object body (e.g. for ICY).
+	GetObjectReader(ctx context.Context, rc recordedChunk) (io.ReadCloser, error)
+	// ServeChunk answers a listener's request for a segment, either with the
+	// body or a redirect to somewhere it can be fetched. An error is only
+	// returned if nothing has been written to w yet.
+	ServeChunk(w http.ResponseWriter, r *http.Request, rc recordedChunk) error
+	// DeleteObject removes an object from the store.
+	DeleteObject(ctx context.Context, objectKey string) error
+}
+
+// objectLister is implemented by stores that can list, read and rename their
+// raw objects, for LoadStream, state that isn't chunks, and one-off
+// maintenance like key migrations.
+type objectLister interface {
+	// GetObject returns an object's body. The error wraps fs.ErrNotExist if
+	// there is no such object.
+	GetObject(ctx context.Context, objectKey string) ([]byte, error)
+	// ListStreams returns the ids of the top-level streams with objects in the
+	// store, configured or not.
+	ListStreams(ctx context.Context) ([]string, error)
+	// ListObjects returns every object stored for a stream.
+	ListObjects(ctx context.Context, streamID string) ([]storedObject, error)
+	// RenameObject moves an object to a new key.
+	RenameObject(ctx context.Context, from, to string) error
+}
+
+// storedObject is one object as listed from a backend.
+type storedObject struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+}
+
+// keyRename is a stored object that needs moving to a new key.
+type keyRename struct {
+	From, To string
+}
+
+// loadStoredStream lists a stream's objects from ol and rebuilds its index,
+// moving any objects whose sequence had to change.
+func loadStoredStream(ctx context.Context, ol objectLister, idx *chunkIndex, streamID string) error {
+	objs, err := ol.ListObjects(ctx, streamID)
+	if err != nil {
+		return err
+	}
+	for _, r := range indexStoredObjects(idx, streamID, objs) {
+		if err := ol.RenameObject(ctx, r.From, r.To); err != nil {
+			return fmt.Errorf("renumbering %s: %w", streamID, err)
+		}
+	}
+	return nil
+}
+
+// indexStoredObjects rebuilds the index for a stream from a backend listing.
+// Objects that don't decode as chunk keys are ignored. FetchedAt comes from the
+// timestamp in the key rather than LastModified, which is set when the upload
+// finishes and may be rewritten by replication or copies. Sequences stored in the
+// key are kept as-is; legacy keys without one are numbered in time order so
+// they sit directly before the first stored sequence (or from 1 if none). If
+// there are more legacy keys than fit before it, the stored sequences that
+// would repeat or go backwards are moved up after them, and returned as
+// renames so the keys can be brought in line. Once they are, the next load
+// numbers everything the same way.
+// Objects of sub-streams, like recorded variants, are indexed under their own
+// ids.
+func indexStoredObjects(idx *chunkIndex, streamID string, objs []storedObject) []keyRename {
+	byStream := map[string][]storedObject{streamID: nil}
+	for _, obj := range objs {
+		id := streamIDFromObjectKey(obj.Key)
+		if id != streamID && !strings.HasPrefix(id, streamID+"/") {
+			continue
+		}
+		byStream[id] = append(byStream[id], obj)
+	}
+	var renames []keyRename
+	for id, objs := range byStream {
+		renames = append(renames, indexStreamObjects(idx, id, objs)...)
+	}
+	return renames
+}
+
+func indexStreamObjects(idx *chunkIndex, streamID string, objs []storedObject) []keyRename {
+	type row struct {
+		keyTime time.Time
+		flags   chunkFlags
+		rc      recordedChunk
+	}
+	var rows []row
+	for _, obj := range objs {
+		_, kt, dur, seq, flags, chunkID, err := decodeObjectKey(obj.Key)
+		if err != nil {
+			continue
+		}
+		rows = append(rows, row{
+			keyTime: kt,
+			flags:   flags,
+			rc: recordedChunk{
+				Sequence:      seq,
+				ChunkID:       chunkID,
+				Duration:      dur,
+				FetchedAt:     kt,
+				ObjectKey:     obj.Key,
+				Size:          obj.Size,
+				Discontinuity: flags&chunkFlagDiscontinuity != 0,
+			},
+		})
+	}
+	// legacy keys first in time order, then the rest by their sequence
+	sort.Slice(rows, func(i, j int) bool {
+		if (rows[i].rc.Sequence == 0) != (rows[j].rc.Sequence == 0) {
+			return rows[i].rc.Sequence == 0
+		}
+		if rows[i].rc.Sequence != rows[j].rc.Sequence {
+			return rows[i].rc.Sequence < rows[j].rc.Sequence
+		}
+		if !rows[i].keyTime.Equal(rows[j].keyTime) {
+			return rows[i].keyTime.Before(rows[j].keyTime)
+		}
+		return rows[i].rc.ObjectKey < rows[j].rc.ObjectKey
+	})
+
+	var legacy int
+	next := 1
+	for _, r := range rows {
+		if r.rc.Sequence != 0 {
+			next = r.rc.Sequence - legacy
+			break
+		}
+		legacy++
+	}
+	next = max(next, 1)
+
+	var renames []keyRename
+	chunks := make([]recordedChunk, len(rows))
+	for i, r := range rows {
+		chunks[i] = r.rc
+		switch {
+		case chunks[i].Sequence == 0:
+			chunks[i].Sequence = next
+		case chunks[i].Sequence < next:
+			chunks[i].Sequence = next
+			chunks[i].ObjectKey = encodeObjectKey(streamID, r.keyTime, r.rc.Duration, next, r.flags, r.rc.ChunkID)
+			renames = append(renames, keyRename{From: r.rc.ObjectKey, To: chunks[i].ObjectKey})
+		}
+		next = chunks[i].Sequence + 1
+	}
+	idx.ReplaceStream(streamID, chunks)
+	return renames
+}
+
+// reservedPrefix starts the keys of tjts' own objects in the store, like
+// sessions. Stream IDs can't start with it, so they never collide with chunks.
+const reservedPrefix = "_"
+
+// isReserved reports if a top level key or directory belongs to tjts rather
+// than a stream.
+func isReserved(name string) bool {
+	return strings.HasPrefix(name, reservedPrefix)
+}
+
+// pinnedVariantPrefix is where the variant each stream records from a master
+// playlist is kept.
+const pinnedVariantPrefix = reservedPrefix + "variants/"
+
+// stationChunkStore is one stream's view of the store, used by its fetcher.
+type stationChunkStore struct {
+	streamID string
+	store    chunkStore
+	idx      *chunkIndex
+}
+
+func newStationChunkStore(streamID string, store chunkStore, idx *chunkIndex) *stationChunkStore {
+	return &stationChunkStore{streamID: streamID, store: store, idx: idx}
+}
+
+// WriteChunk stores a segment and adds it to the index. start is when the
+// segment started in broadcast time, and title is its EXTINF title, if any.
+// discontinuity marks a segment that doesn't follow on from the last one
+// recorded.
+func (s *stationChunkStore) WriteChunk(ctx context.Context, chunkName string, start time.Time, chunkDuration float64, title string, discontinuity bool, r io.Reader) error {
+	if s.idx.HasLogical(s.streamID, chunkName) {
+		return nil
+	}
+	seq := s.idx.NextSequence(s.streamID)
+	ts := start.UTC()
+	flags := chunkFlagBroadcastTime
+	if discontinuity {
+		flags |= chunkFlagDiscontinuity
+	}
+	key := encodeObjectKey(s.streamID, ts, chunkDuration, seq, flags, chunkName)
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read chunk body: %w", err)
+	}
+	if err := s.store.PutObject(ctx, key, body); err != nil {
+		return err
+	}
+	s.idx.Append(s.streamID, recordedChunk{
+		Sequence:      seq,
+		ChunkID:       chunkName,
+		Duration:      chunkDuration,
+		FetchedAt:     ts,
+		ObjectKey:     key,
+		Size:          int64(len(body)),
+		Title:         title,
+		Discontinuity: discontinuity,
+	})
+	return nil
+}
+
+func (s *stationChunkStore) ChunkExists(_ context.Context, chunkName string) bool {
+	return s.idx.HasLogical(s.streamID, chunkName)
+}
+
+// Empty reports if nothing is recorded for the stream.
+func (s *stationChunkStore) Empty() bool {
+	_, _, ok := s.idx.Span(s.streamID)
+	return !ok
+}
+
+// variant returns the store for one of the stream's variants.
+func (s *stationChunkStore) variant(v streamVariant) *stationChunkStore {
+	return newStationChunkStore(v.ID, s.store, s.idx)
+}
+
+// PinnedVariant returns the variant last pinned for the stream with
+// SetPinnedVariant. The error wraps fs.ErrNotExist if there isn't one.
+func (s *stationChunkStore) PinnedVariant(ctx context.Context) (string, error) {
+	ol, ok := s.raw().(objectLister)
+	if !ok {
+		return "", fmt.Errorf("pinned variant: %w", fs.ErrNotExist)
+	}
+	b, err := ol.GetObject(ctx, pinnedVariantPrefix+s.streamID)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// SetPinnedVariant stores the variant the stream records, as described by
+// sourceVariant.String.
+func (s *stationChunkStore) SetPinnedVariant(ctx context.Context, v string) error {
+	return s.raw().PutObject(ctx, pinnedVariantPrefix+s.streamID, []byte(v))
+}
+
+// raw returns the backend under any caching or proxying, for objects that
+// aren't chunks.
+func (s *stationChunkStore) raw() chunkStore {
+	cs := s.store
+	for {
+		u, ok := cs.(interface{ Unwrap() chunkStore })
+		if !ok {
+			return cs
+		}
+		cs = u.Unwrap()
+	}
+}
+
+// SetVariants records which variants of the stream are being recorded.
+func (s *stationChunkStore) SetVariants(vs []streamVariant) {
+	s.idx.SetVariants(s.streamID, vs)
+}
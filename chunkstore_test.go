@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIndexStoredObjectsSequences(t *testing.T) {
+	ctx := context.Background()
+	t0 := time.Date(2026, 4, 7, 0, 0, 0, 0, time.UTC)
+
+	legacyKey := func(ts time.Time, cid string) string {
+		return fmt.Sprintf("s/%019d__d10000__%s", ts.UnixNano(), base64.RawURLEncoding.EncodeToString([]byte(cid)))
+	}
+
+	objs := []storedObject{
+		// listing order shouldn't matter
+		{Key: encodeObjectKey("s", t0.Add(30*time.Second), 10, 41, 0, "c.ts")},
+		{Key: legacyKey(t0, "a.ts")},
+		{Key: encodeObjectKey("s", t0.Add(40*time.Second), 10, 42, chunkFlagDiscontinuity, "d.ts")},
+		{Key: legacyKey(t0.Add(10*time.Second), "b.ts")},
+		{Key: "s/not-a-chunk"},
+	}
+
+	idx := newChunkIndex()
+	indexStoredObjects(idx, "s", objs)
+
+	cs, err := idx.Chunks(ctx, "s", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range cs {
+		got = append(got, fmt.Sprintf("%s:%d:%t", c.ChunkID, c.Sequence, c.Discontinuity))
+	}
+	want := []string{"a.ts:39:false", "b.ts:40:false", "c.ts:41:false", "d.ts:42:true"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if n := idx.NextSequence("s"); n != 43 {
+		t.Errorf("want next sequence 43, got %d", n)
+	}
+
+	// more legacy chunks than fit before the first stored sequence
+	objs = []storedObject{
+		{Key: legacyKey(t0, "a.ts")},
+		{Key: legacyKey(t0.Add(10*time.Second), "b.ts")},
+		{Key: legacyKey(t0.Add(20*time.Second), "c.ts")},
+		{Key: encodeObjectKey("s", t0.Add(30*time.Second), 10, 2, 0, "d.ts")},
+		{Key: encodeObjectKey("s", t0.Add(40*time.Second), 10, 3, 0, "e.ts")},
+	}
+	want = []string{"a.ts:1", "b.ts:2", "c.ts:3", "d.ts:4", "e.ts:5"}
+	// and the keys are renamed, so it loads the same way again
+	for range 2 {
+		idx = newChunkIndex()
+		renames := indexStoredObjects(idx, "s", objs)
+		cs, err = idx.Chunks(ctx, "s", 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = nil
+		for _, c := range cs {
+			got = append(got, fmt.Sprintf("%s:%d", c.ChunkID, c.Sequence))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("want the stored run moved up after the legacy chunks %v, got %v", want, got)
+		}
+		for _, r := range renames {
+			for i := range objs {
+				if objs[i].Key == r.From {
+					objs[i].Key = r.To
+				}
+			}
+		}
+	}
+	if objs[3].Key != encodeObjectKey("s", t0.Add(30*time.Second), 10, 4, 0, "d.ts") {
+		t.Errorf("want d.ts renamed to sequence 4, got %s", objs[3].Key)
+	}
+}
+
+func TestChunkIndexGaps(t *testing.T) {
+	t0 := time.Date(2026, 4, 7, 0, 0, 0, 0, time.UTC)
+	idx := newChunkIndex()
+	idx.Append("s", recordedChunk{Sequence: 1, ChunkID: "a.ts", Duration: 10, FetchedAt: t0})
+	idx.Append("s", recordedChunk{Sequence: 2, ChunkID: "b.ts", Duration: 10, FetchedAt: t0.Add(10 * time.Second)})
+	// down for a minute
+	idx.Append("s", recordedChunk{Sequence: 3, ChunkID: "c.ts", Duration: 10, FetchedAt: t0.Add(80 * time.Second), Discontinuity: true})
+	// source discontinuity, nothing missing
+	idx.Append("s", recordedChunk{Sequence: 4, ChunkID: "d.ts", Duration: 10, FetchedAt: t0.Add(90 * time.Second), Discontinuity: true})
+
+	gaps := idx.Gaps("s")
+	want := []timelineGap{
+		{Sequence: 3, At: t0.Add(80 * time.Second), Missing: time.Minute},
+		{Sequence: 4, At: t0.Add(90 * time.Second)},
+	}
+	if fmt.Sprint(gaps) != fmt.Sprint(want) {
+		t.Errorf("want gaps %v, got %v", want, gaps)
+	}
+
+	// a stream with variants has the gaps of the variant it's served from
+	hi := newStreamVariant("v", 128000, 0, "")
+	idx.Append(hi.ID, recordedChunk{Sequence: 1, ChunkID: "a.ts", Duration: 10, FetchedAt: t0})
+	idx.Append(hi.ID, recordedChunk{Sequence: 2, ChunkID: "b.ts", Duration: 10, FetchedAt: t0.Add(40 * time.Second), Discontinuity: true})
+	idx.SetVariants("v", []streamVariant{hi})
+	want = []timelineGap{{Sequence: 2, At: t0.Add(40 * time.Second), Missing: 30 * time.Second}}
+	if gaps := idx.Gaps("v"); fmt.Sprint(gaps) != fmt.Sprint(want) {
+		t.Errorf("want variant gaps %v, got %v", want, gaps)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -10,15 +12,158 @@ import (
 )
 
 const (
-	defaultMaxOffset  = 24 * time.Hour
-	defaultPresignTTL = time.Hour
+	defaultMaxOffset     = 24 * time.Hour
+	defaultPresignTTL    = time.Hour
+	defaultGCInterval    = 1 * time.Hour
+	defaultSessionMaxAge = 12 * time.Hour
+	defaultFailures      = 3
+	defaultStale         = time.Minute
+	defaultStallTargets  = 3
+	defaultMaxBackoff    = 2 * time.Minute
 )
 
 type configStream struct {
-	ID           string `yaml:"id"`
-	Name         string `yaml:"name"`
-	URL          string `yaml:"url"`
-	BaseTimezone string `yaml:"baseTimezone"`
+	ID   string `yaml:"id"`
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// URLs are backup sources, e.g. other CDNs, tried in order after URL.
+	// Segments we already have from another source are skipped, by media
+	// sequence or content.
+	URLs []string `yaml:"urls"`
+	// Failover is when to move between the sources.
+	Failover failoverConfig `yaml:"failover"`
+	// Health is when the stream's fetcher is considered unwell.
+	Health       fetchHealthConfig `yaml:"health"`
+	BaseTimezone string            `yaml:"baseTimezone"`
+	// DSTPolicy is what long-lived listeners hear when their offset to the
+	// base timezone changes, continuous (default) or wallclock.
+	DSTPolicy dstPolicy `yaml:"dstPolicy"`
+	// AheadOfBase is what listeners ahead of the base timezone hear by
+	// default, live (default) or previousDay.
+	AheadOfBase aheadPolicy `yaml:"aheadOfBase"`
+	// Retention bounds how much of the stream is kept.
+	Retention retentionConfig `yaml:"retention"`
+	// Language picks the audio track by ISO 639 code when the source has
+	// several, otherwise the first is used. ICY's ?lang= overrides it.
+	Language string `yaml:"language"`
+	// DVRWindow, if set, serves HLS listeners this much audio behind their
+	// shifted live edge so they can seek back. ?dvr= overrides it.
+	DVRWindow time.Duration `yaml:"dvrWindow"`
+	// RecordVariants records every variant of a master playlist source as a
+	// sub-stream, stream/bandwidth[-n], and serves HLS listeners a master playlist
+	// of them. RecordBandwidths limits it to the variants with those
+	// bandwidths. Otherwise only the highest bandwidth one is recorded.
+	RecordVariants   bool  `yaml:"recordVariants"`
+	RecordBandwidths []int `yaml:"recordBandwidths"`
+	// Variant picks which variant of a master playlist source is recorded.
+	// Its filters also apply to RecordVariants.
+	Variant variantConfig `yaml:"variant"`
+}
+
+// failoverConfig is when a stream with several sources moves between them.
+// The sources should share EXT-X-MEDIA-SEQUENCE numbering, as a segment at a
+// sequence already recorded is taken to be the same one.
+type failoverConfig struct {
+	// Failures is how many polls in a row can fail before moving on to the
+	// next source. Defaults to 3.
+	Failures int `yaml:"failures"`
+	// Stale moves on when a source hasn't given us a new segment for this
+	// long. Defaults to a minute.
+	Stale time.Duration `yaml:"stale"`
+	// Failback, if set, goes back to the first source after this long on a
+	// backup. Otherwise the backup is used until it fails.
+	Failback time.Duration `yaml:"failback"`
+}
+
+// fetchHealthConfig is when a stream's fetcher is considered unwell, and how
+// it backs off. It's failing once failover.failures polls in a row fail.
+type fetchHealthConfig struct {
+	// StallTargetDurations is how many of the source's target durations its
+	// media sequence can stay the same before it's stalled. Defaults to 3.
+	StallTargetDurations int `yaml:"stallTargetDurations"`
+	// MaxBackoff caps the wait between polls while they're failing. Defaults
+	// to 2 minutes.
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+// sources returns the URLs to fetch the stream from, in order of preference.
+func (s configStream) sources() []string {
+	return append([]string{s.URL}, s.URLs...)
+}
+
+// retentionConfig bounds how much of a stream is kept.
+type retentionConfig struct {
+	// MaxAge drops chunks older than this, and is the furthest a listener can
+	// be shifted. Defaults to maxOffset.
+	MaxAge time.Duration `yaml:"maxAge"`
+	// MaxBytes, if set, drops the oldest chunks once the stream's total size,
+	// including all its variants, exceeds it.
+	MaxBytes int64 `yaml:"maxBytes"`
+}
+
+// gcConfig configures the garbage collector.
+type gcConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	// SessionMaxAge drops HLS sessions that haven't been polled for this long.
+	// Token sessions can't tell, so they expire this long after joining.
+	SessionMaxAge time.Duration `yaml:"sessionMaxAge"`
+}
+
+// checkOffset returns an error if a listener offset reaches further back than
+// the stream retains.
+func (s configStream) checkOffset(offset time.Duration) error {
+	if offset > s.Retention.MaxAge {
+		return fmt.Errorf("offset %s is beyond the %s retained for %s", offset, s.Retention.MaxAge, s.ID)
+	}
+	return nil
+}
+
+// dvrWindow returns the DVR window for a listener, from the request if set or
+// the stream's default otherwise. It is capped to the retention.
+func (s configStream) dvrWindow(requested string) (time.Duration, error) {
+	w := s.DVRWindow
+	if requested != "" {
+		d, err := time.ParseDuration(requested)
+		if err != nil {
+			return 0, fmt.Errorf("parsing dvr %s: %v", requested, err)
+		}
+		if d < 0 {
+			return 0, fmt.Errorf("dvr %s can't be negative", requested)
+		}
+		w = d
+	}
+	return min(w, s.Retention.MaxAge), nil
+}
+
+// findStream returns the configured stream with the given ID.
+func findStream(streams []configStream, id string) (configStream, bool) {
+	for _, s := range streams {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return configStream{}, false
+}
+
+const (
+	storageS3         = "s3"
+	storageFilesystem = "filesystem"
+)
+
+// storageConfig selects where recorded chunks are kept.
+type storageConfig struct {
+	// Type is the backend, s3 (default) or filesystem.
+	Type       string           `yaml:"type"`
+	Filesystem filesystemConfig `yaml:"filesystem"`
+	// ChunkServing is how /chunk hands out S3 chunks, redirect (default) to
+	// a presigned URL, or proxy to stream them through tjts. Filesystem chunks
+	// are always served directly.
+	ChunkServing string `yaml:"chunkServing"`
+}
+
+// filesystemConfig configures storing chunks in a local directory.
+type filesystemConfig struct {
+	Root string `yaml:"root"`
 }
 
 // s3Config configures S3-compatible object storage (DigitalOcean Spaces, MinIO, AWS S3).
@@ -32,9 +177,69 @@ type s3Config struct {
 	PresignTTL   time.Duration `yaml:"presignTTL"`
 }
 
+const (
+	sessionStoreMemory = "memory"
+	sessionStoreToken  = "token"
+	sessionStoreS3     = "s3"
+	sessionStoreRedis  = "redis"
+)
+
+// sessionsConfig selects where HLS session state is kept.
+type sessionsConfig struct {
+	// Store is memory (default), token to carry the session in a signed sid,
+	// s3 to keep sessions in the chunk bucket, or redis. All but memory let
+	// any replica serve any session.
+	Store string `yaml:"store"`
+	// Secret signs token sessions. Every replica needs the same one.
+	Secret string      `yaml:"secret"`
+	Redis  redisConfig `yaml:"redis"`
+}
+
+// redisConfig configures a server speaking the Redis protocol.
+type redisConfig struct {
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+// cacheConfig sizes the chunk read cache. It is off unless maxBytes is set.
+type cacheConfig struct {
+	// MaxBytes is how much chunk data to hold in memory.
+	MaxBytes int64 `yaml:"maxBytes"`
+	// Disk optionally holds chunks pushed out of memory.
+	Disk diskCacheConfig `yaml:"disk"`
+}
+
+type diskCacheConfig struct {
+	Dir      string `yaml:"dir"`
+	MaxBytes int64  `yaml:"maxBytes"`
+}
+
+// icyConfig configures the /icecast endpoint.
+type icyConfig struct {
+	// MetaInt is the bytes of audio between metadata blocks, for clients that
+	// ask for them.
+	MetaInt int `yaml:"metaInt"`
+	// StallTimeout is how long a listener is kept connected waiting for new
+	// chunks, e.g. at the live edge or while the fetcher is down.
+	StallTimeout time.Duration `yaml:"stallTimeout"`
+	// Fill is what to send while waiting: none, silence, or slate to loop
+	// the ADTS file at SlatePath. Only AAC streams are filled.
+	Fill      string `yaml:"fill"`
+	SlatePath string `yaml:"slatePath"`
+	// GapPolicy is what to do at a gap in the recording: skip straight to
+	// the next chunk, or play silence for the missing time (up to a minute).
+	GapPolicy string `yaml:"gapPolicy"`
+}
+
 type configFile struct {
+	Storage       storageConfig  `yaml:"storage"`
 	S3            s3Config       `yaml:"s3"`
+	Cache         cacheConfig    `yaml:"cache"`
+	ICY           icyConfig      `yaml:"icy"`
 	MaxOffsetTime time.Duration  `yaml:"maxOffset"`
+	GC            gcConfig       `yaml:"gc"`
+	Sessions      sessionsConfig `yaml:"sessions"`
 	Streams       []configStream `yaml:"streams"`
 }
 
@@ -52,33 +257,198 @@ func loadAndValdiateConfig(path string) (configFile, error) {
 
 	var ems []string
 
-	if cf.S3.Bucket == "" {
-		ems = append(ems, "s3.bucket must be specified")
+	if cf.Storage.Type == "" {
+		cf.Storage.Type = storageS3
 	}
-	if cf.S3.Region == "" {
-		ems = append(ems, "s3.region must be specified")
+	switch cf.Storage.Type {
+	case storageS3:
+		if cf.S3.Bucket == "" {
+			ems = append(ems, "s3.bucket must be specified")
+		}
+		if cf.S3.Region == "" {
+			ems = append(ems, "s3.region must be specified")
+		}
+	case storageFilesystem:
+		if cf.Storage.Filesystem.Root == "" {
+			ems = append(ems, "storage.filesystem.root must be specified")
+		}
+	default:
+		ems = append(ems, fmt.Sprintf("unknown storage.type %q", cf.Storage.Type))
+	}
+	if cf.Storage.ChunkServing == "" {
+		cf.Storage.ChunkServing = chunkServingRedirect
+	}
+	if cf.Storage.ChunkServing != chunkServingRedirect && cf.Storage.ChunkServing != chunkServingProxy {
+		ems = append(ems, fmt.Sprintf("unknown storage.chunkServing %q", cf.Storage.ChunkServing))
 	}
 	if len(cf.Streams) == 0 {
 		ems = append(ems, "must specify at least one stream")
 	}
-	for _, s := range cf.Streams {
+	for i := range cf.Streams {
+		s := &cf.Streams[i]
 		if s.ID == "" {
 			ems = append(ems, "streams must have id")
 		}
+		if isReserved(s.ID) {
+			ems = append(ems, fmt.Sprintf("%s: stream id can't start with %s", s.ID, reservedPrefix))
+		}
 		if s.Name == "" {
 			ems = append(ems, fmt.Sprintf("%s: stream must have name", s.ID))
 		}
 		if s.URL == "" {
 			ems = append(ems, fmt.Sprintf("%s: stream must have url", s.ID))
 		}
+		if slices.Contains(s.URLs, "") {
+			ems = append(ems, fmt.Sprintf("%s: urls can't be empty", s.ID))
+		}
+		if s.Failover.Failures == 0 {
+			s.Failover.Failures = defaultFailures
+		}
+		if s.Failover.Stale == 0 {
+			s.Failover.Stale = defaultStale
+		}
+		if s.Failover.Failures < 0 || s.Failover.Stale < 0 || s.Failover.Failback < 0 {
+			ems = append(ems, fmt.Sprintf("%s: failover settings can't be negative", s.ID))
+		}
+		if s.Health.StallTargetDurations == 0 {
+			s.Health.StallTargetDurations = defaultStallTargets
+		}
+		if s.Health.MaxBackoff == 0 {
+			s.Health.MaxBackoff = defaultMaxBackoff
+		}
+		if s.Health.StallTargetDurations < 0 || s.Health.MaxBackoff < 0 {
+			ems = append(ems, fmt.Sprintf("%s: health settings can't be negative", s.ID))
+		}
 		if s.BaseTimezone == "" {
 			ems = append(ems, fmt.Sprintf("%s: stream must have base timezone", s.ID))
 		}
+		if s.DSTPolicy == "" {
+			s.DSTPolicy = dstContinuous
+		}
+		if !s.DSTPolicy.valid() {
+			ems = append(ems, fmt.Sprintf("%s: unknown dstPolicy %q", s.ID, s.DSTPolicy))
+		}
+		if s.AheadOfBase == "" {
+			s.AheadOfBase = aheadLive
+		}
+		if !s.AheadOfBase.valid() {
+			ems = append(ems, fmt.Sprintf("%s: unknown aheadOfBase %q", s.ID, s.AheadOfBase))
+		}
+		if strings.Contains(s.ID, "/") {
+			// separates the stream from its variants
+			ems = append(ems, fmt.Sprintf("%s: stream id can't contain /", s.ID))
+		}
+		if len(s.RecordBandwidths) > 0 && !s.RecordVariants {
+			ems = append(ems, fmt.Sprintf("%s: recordBandwidths needs recordVariants", s.ID))
+		}
+		for _, bw := range s.RecordBandwidths {
+			if bw <= 0 {
+				ems = append(ems, fmt.Sprintf("%s: recordBandwidths must be positive, got %d", s.ID, bw))
+			}
+		}
+		if s.Variant.Select == "" {
+			s.Variant.Select = variantSelectMaxBandwidth
+		}
+		if s.Variant.Select != variantSelectMaxBandwidth && s.Variant.Select != variantSelectMinBandwidth {
+			ems = append(ems, fmt.Sprintf("%s: unknown variant.select %q", s.ID, s.Variant.Select))
+		}
+		if s.Variant.URI != "" {
+			re, err := regexp.Compile(s.Variant.URI)
+			if err != nil {
+				ems = append(ems, fmt.Sprintf("%s: variant.uri: %v", s.ID, err))
+			}
+			s.Variant.uri = re
+		}
 	}
 
 	if cf.MaxOffsetTime == 0 {
 		cf.MaxOffsetTime = defaultMaxOffset
 	}
+	for i := range cf.Streams {
+		s := &cf.Streams[i]
+		if s.Retention.MaxAge == 0 {
+			s.Retention.MaxAge = cf.MaxOffsetTime
+		}
+		if s.Retention.MaxBytes < 0 {
+			ems = append(ems, fmt.Sprintf("%s: retention.maxBytes can't be negative", s.ID))
+		}
+		if s.DVRWindow < 0 || s.DVRWindow > s.Retention.MaxAge {
+			ems = append(ems, fmt.Sprintf("%s: dvrWindow must be between 0 and the retention of %s", s.ID, s.Retention.MaxAge))
+		}
+		if s.AheadOfBase == aheadPreviousDay && s.Retention.MaxAge < 24*time.Hour {
+			ems = append(ems, fmt.Sprintf("%s: aheadOfBase previousDay needs retention of at least 24h, have %s", s.ID, s.Retention.MaxAge))
+		}
+	}
+	if cf.Sessions.Store == "" {
+		cf.Sessions.Store = sessionStoreMemory
+	}
+	switch cf.Sessions.Store {
+	case sessionStoreMemory:
+	case sessionStoreToken:
+		if len(cf.Sessions.Secret) < 32 {
+			ems = append(ems, "sessions.secret must be at least 32 characters for token sessions")
+		}
+		for _, s := range cf.Streams {
+			if s.DSTPolicy == dstWallclock {
+				ems = append(ems, fmt.Sprintf("%s: dstPolicy wallclock can't be used with token sessions", s.ID))
+			}
+			if s.DVRWindow > 0 {
+				ems = append(ems, fmt.Sprintf("%s: dvrWindow can't be used with token sessions", s.ID))
+			}
+		}
+	case sessionStoreS3:
+		if cf.Storage.Type != storageS3 {
+			ems = append(ems, "sessions.store s3 needs storage.type s3")
+		}
+	case sessionStoreRedis:
+		if cf.Sessions.Redis.Addr == "" {
+			ems = append(ems, "sessions.redis.addr must be specified")
+		}
+	default:
+		ems = append(ems, fmt.Sprintf("unknown sessions.store %q", cf.Sessions.Store))
+	}
+	if cf.Cache.MaxBytes < 0 || cf.Cache.Disk.MaxBytes < 0 {
+		ems = append(ems, "cache sizes can't be negative")
+	}
+	if cf.Cache.Disk.Dir != "" && (cf.Cache.MaxBytes == 0 || cf.Cache.Disk.MaxBytes == 0) {
+		ems = append(ems, "cache.disk needs cache.maxBytes and cache.disk.maxBytes")
+	}
+	if cf.ICY.MetaInt == 0 {
+		cf.ICY.MetaInt = defaultICYMetaInt
+	}
+	if cf.ICY.MetaInt < 0 {
+		ems = append(ems, "icy.metaInt can't be negative")
+	}
+	if cf.ICY.StallTimeout == 0 {
+		cf.ICY.StallTimeout = defaultICYStallTimeout
+	}
+	if cf.ICY.StallTimeout < 0 {
+		ems = append(ems, "icy.stallTimeout can't be negative")
+	}
+	if cf.ICY.Fill == "" {
+		cf.ICY.Fill = icyFillNone
+	}
+	switch cf.ICY.Fill {
+	case icyFillNone, icyFillSilence:
+	case icyFillSlate:
+		if cf.ICY.SlatePath == "" {
+			ems = append(ems, "icy.slatePath must be specified for slate fill")
+		}
+	default:
+		ems = append(ems, fmt.Sprintf("unknown icy.fill %q", cf.ICY.Fill))
+	}
+	if cf.ICY.GapPolicy == "" {
+		cf.ICY.GapPolicy = icyGapSkip
+	}
+	if cf.ICY.GapPolicy != icyGapSkip && cf.ICY.GapPolicy != icyGapSilence {
+		ems = append(ems, fmt.Sprintf("unknown icy.gapPolicy %q", cf.ICY.GapPolicy))
+	}
+	if cf.GC.Interval == 0 {
+		cf.GC.Interval = defaultGCInterval
+	}
+	if cf.GC.SessionMaxAge == 0 {
+		cf.GC.SessionMaxAge = defaultSessionMaxAge
+	}
 	if cf.S3.PresignTTL == 0 {
 		cf.S3.PresignTTL = defaultPresignTTL
 	}
@@ -1,9 +1,117 @@
 package main
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
 
 func TestConfig(t *testing.T) {
 	if _, err := loadAndValdiateConfig("config.yaml"); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestConfigAheadNeedsRetention(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte(`
+storage:
+  type: filesystem
+  filesystem:
+    root: /tmp/tjts
+maxOffset: 12h
+streams:
+  - id: s
+    name: S
+    url: http://example.com/s.m3u8
+    baseTimezone: Australia/Sydney
+    aheadOfBase: previousDay
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadAndValdiateConfig(p)
+	if err == nil || !strings.Contains(err.Error(), "previousDay needs retention") {
+		t.Fatalf("want retention error, got %v", err)
+	}
+}
+
+func TestConfigTokenSessions(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte(`
+storage:
+  type: filesystem
+  filesystem:
+    root: /tmp/tjts
+sessions:
+  store: token
+  secret: short
+streams:
+  - id: s
+    name: S
+    url: http://example.com/s.m3u8
+    baseTimezone: Australia/Sydney
+    dstPolicy: wallclock
+    dvrWindow: 10m
+    retention:
+      maxAge: 1h
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadAndValdiateConfig(p)
+	if err == nil || !strings.Contains(err.Error(), "sessions.secret") || !strings.Contains(err.Error(), "wallclock can't be used with token sessions") ||
+		!strings.Contains(err.Error(), "dvrWindow can't be used with token sessions") {
+		t.Fatalf("want secret, wallclock and dvrWindow errors, got %v", err)
+	}
+}
+
+func TestConfigVariant(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte(`
+storage:
+  type: filesystem
+  filesystem:
+    root: /tmp/tjts
+streams:
+  - id: s
+    name: S
+    url: http://example.com/s.m3u8
+    baseTimezone: Australia/Sydney
+    variant:
+      select: biggest
+      uri: "hi/(.*"
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadAndValdiateConfig(p)
+	if err == nil || !strings.Contains(err.Error(), `unknown variant.select "biggest"`) || !strings.Contains(err.Error(), "variant.uri") {
+		t.Fatalf("want select and uri errors, got %v", err)
+	}
+}
+
+func TestConfigFailover(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte(`
+storage:
+  type: filesystem
+  filesystem:
+    root: /tmp/tjts
+streams:
+  - id: s
+    name: S
+    url: http://example.com/s.m3u8
+    urls:
+      - http://backup.example.com/s.m3u8
+    baseTimezone: Australia/Sydney
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadAndValdiateConfig(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cfg.Streams[0]
+	if len(s.sources()) != 2 || s.Failover.Failures != defaultFailures || s.Failover.Stale != defaultStale {
+		t.Errorf("want both sources with default failover, got %v %+v", s.sources(), s.Failover)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	downloadFormatAAC = "aac"
+	downloadFormatTS  = "ts"
+)
+
+// downloadServer serves a time range of a stream as a single audio file.
+type downloadServer struct {
+	l logrus.FieldLogger
+
+	streams []configStream
+
+	indexer *chunkIndex
+	store   chunkStore
+}
+
+func newDownloadServer(l logrus.FieldLogger, s []configStream, i *chunkIndex, st chunkStore) *downloadServer {
+	return &downloadServer{
+		l:       l,
+		streams: s,
+		indexer: i,
+		store:   st,
+	}
+}
+
+// ServeDownload serves ?stream=&from=&to=[&format=aac|ts] as one file. aac
+// (the default) is the audio extracted from TS chunks the same way as for ICY,
+// so is sent as MP3 for MPEG audio sources. ts concatenates the recorded
+// segments, so needs TS chunks.
+func (d *downloadServer) ServeDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	q := r.URL.Query()
+	streamID := q.Get("stream")
+	if streamID == "" {
+		http.Error(w, "stream, from and to must be present on query", http.StatusBadRequest)
+		return
+	}
+	st, ok := findStream(d.streams, streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+
+	format := q.Get("format")
+	if format == "" {
+		format = downloadFormatAAC
+	}
+	if format != downloadFormatAAC && format != downloadFormatTS {
+		http.Error(w, fmt.Sprintf("unknown format %q, want aac or ts", format), http.StatusBadRequest)
+		return
+	}
+
+	rcs, err := retainedRange(d.indexer, st, q, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the length is only known up front if every chunk is sent unmodified and
+	// we know its size. aac is re-framed, so can drop partial frames.
+	var length int64
+	for _, rc := range rcs {
+		isAAC := filepath.Ext(rc.ChunkID) == ".aac"
+		if format == downloadFormatTS && isAAC {
+			http.Error(w, "stream is recorded as aac, ts is not available", http.StatusBadRequest)
+			return
+		}
+		if length >= 0 && rc.Size > 0 && format == downloadFormatTS {
+			length += rc.Size
+		} else {
+			length = -1
+		}
+	}
+
+	l := d.l.WithField("stream", streamID)
+	contentType, ext := "video/mp2t", "ts"
+	var first chunkAudio
+	if format == downloadFormatAAC {
+		// the content type depends on the source's codec, so load the first
+		// chunk before sending headers.
+		if first, err = readChunkAudio(ctx, d.store, rcs[0], st.Language); err != nil {
+			serveEndpointErrorCount.WithLabelValues("download", streamID).Inc()
+			l.WithError(err).Errorf("reading chunk %s", rcs[0].ChunkID)
+			http.Error(w, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+		contentType, ext = first.contentType, audioExtensions[first.contentType]
+	}
+	filename := fmt.Sprintf("%s-%s.%s", streamID, rcs[0].FetchedAt.In(loadLocationOrUTC(st.BaseTimezone)).Format("20060102-1504"), ext)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	if length >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	var joiner audioJoiner
+	for i, rc := range rcs {
+		switch {
+		case format == downloadFormatTS:
+			err = copyChunk(ctx, d.store, w, rc)
+		case i == 0:
+			err = joiner.Write(w, rc, first)
+		default:
+			var ca chunkAudio
+			if ca, err = readChunkAudio(ctx, d.store, rc, st.Language); err == nil {
+				err = joiner.Write(w, rc, ca)
+			}
+		}
+		if err != nil {
+			// headers are gone, all we can do is cut the response short
+			serveEndpointErrorCount.WithLabelValues("download", streamID).Inc()
+			l.WithError(err).Errorf("writing chunk %s", rc.ChunkID)
+			return
+		}
+	}
+}
+
+// copyChunk writes a chunk's stored body to w unmodified.
+func copyChunk(ctx context.Context, store chunkStore, w io.Writer, rc recordedChunk) error {
+	cr, err := store.GetObjectReader(ctx, rc)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	if _, err := io.Copy(w, cr); err != nil {
+		return fmt.Errorf("copying %s: %w", rc.ObjectKey, err)
+	}
+	return nil
+}
+
+// loadLocationOrUTC loads a zone for display purposes, falling back to UTC.
+func loadLocationOrUTC(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestServeDownload(t *testing.T) {
+	ctx := context.Background()
+	idx := newChunkIndex()
+	store, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	for i := range 6 {
+		cid := fmt.Sprintf("chunk-%d.aac", i+1)
+		key := encodeObjectKey("s", t0.Add(time.Duration(i)*10*time.Second), 10, i+1, 0, cid)
+		body := testADTSFrame(byte(i+1), 3)
+		if err := store.PutObject(ctx, key, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.LoadStream(ctx, "s"); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := newDownloadServer(logrus.New(), []configStream{{ID: "s", BaseTimezone: "UTC"}}, idx, store)
+	get := func(format string) *httptest.ResponseRecorder {
+		q := url.Values{"stream": {"s"}, "from": {"2026-01-15T00:00:10Z"}, "to": {"2026-01-15T00:00:40Z"}}
+		if format != "" {
+			q.Set("format", format)
+		}
+		rec := httptest.NewRecorder()
+		ds.ServeDownload(rec, httptest.NewRequest("GET", "/download?"+q.Encode(), nil))
+		return rec
+	}
+
+	rec := get("")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	want := slices.Concat(testADTSFrame(2, 3), testADTSFrame(3, 3), testADTSFrame(4, 3))
+	if got := rec.Body.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("want chunks 2-4 concatenated, got %x", got)
+	}
+	if got := rec.Header().Get("Content-Disposition"); !strings.Contains(got, `filename=s-20260115-0000.aac`) {
+		t.Errorf("unexpected content disposition %q", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "audio/aac" {
+		t.Errorf("want audio/aac, got %q", got)
+	}
+
+	if rec := get("ts"); rec.Code != http.StatusBadRequest {
+		t.Errorf("ts from aac chunks should be rejected, got %d", rec.Code)
+	}
+	if rec := get("flac"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown format should be rejected, got %d", rec.Code)
+	}
+}
+
+func TestServeDownloadMPEGAudio(t *testing.T) {
+	ctx := context.Background()
+	idx := newChunkIndex()
+	store, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	cc := map[int]byte{}
+	var want []byte
+	for i := range 2 {
+		frame := bytes.Repeat([]byte{byte(i + 1)}, 50)
+		want = append(want, frame...)
+		ts := buildTestTS([]testES{{pid: 0x101, streamType: 0x03, pes: [][]byte{frame}}}, cc)
+		key := encodeObjectKey("s", t0.Add(time.Duration(i)*10*time.Second), 10, i+1, 0, fmt.Sprintf("chunk-%d.ts", i+1))
+		if err := store.PutObject(ctx, key, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.LoadStream(ctx, "s"); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := newDownloadServer(logrus.New(), []configStream{{ID: "s", BaseTimezone: "UTC"}}, idx, store)
+	q := url.Values{"stream": {"s"}, "from": {"2026-01-15T00:00:00Z"}, "to": {"2026-01-15T00:00:20Z"}}
+	rec := httptest.NewRecorder()
+	ds.ServeDownload(rec, httptest.NewRequest("GET", "/download?"+q.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != contentTypeMPEG {
+		t.Errorf("want %s, got %q", contentTypeMPEG, got)
+	}
+	if got := rec.Header().Get("Content-Disposition"); !strings.Contains(got, `filename=s-20260115-0000.mp3`) {
+		t.Errorf("unexpected content disposition %q", got)
+	}
+	if got := rec.Body.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("want both chunks' audio, got %x", got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// dvrWindow prepends up to window of audio before the listener's shifted live
+// edge to the live segments, so players can seek back.
+//
+// The playlist stays a sliding live window, not EVENT; the README says why.
+//
+// If the player is behind the window, it is stretched back to where it is
+// playing, up to twice the window, so its segments don't vanish underneath it.
+// It never goes back past the last jump, as chunks before that were numbered
+// under a different SequenceShift.
+func (p *playlist) dvrWindow(ctx context.Context, sess *sessionData, live []recordedChunk, window time.Duration) ([]recordedChunk, error) {
+	edge := live[0]
+	from := edge.FetchedAt.Add(-window)
+
+	if sess.PlayheadSequence > 0 && sess.PlayheadSequence < edge.Sequence {
+		ph, err := p.indexer.Chunks(ctx, sess.StreamID, sess.PlayheadSequence, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(ph) > 0 && ph[0].FetchedAt.Before(from) {
+			from = ph[0].FetchedAt
+			if limit := edge.FetchedAt.Add(-2 * window); from.Before(limit) {
+				from = limit
+			}
+		}
+	}
+
+	minSeq := 0
+	if n := len(sess.Discontinuities); n > 0 {
+		minSeq = sess.Discontinuities[n-1] - sess.SequenceShift
+	}
+
+	var out []recordedChunk
+	for _, rc := range p.indexer.ChunksBetween(sess.StreamID, from, edge.FetchedAt) {
+		if rc.Sequence < minSeq || rc.Sequence >= edge.Sequence {
+			continue
+		}
+		out = append(out, rc)
+	}
+	return append(out, live...), nil
+}
+
+// trackPlayhead records the chunk a DVR player fetched as its position.
+// Chunks of a variant are mapped to the primary variant's chunk playing at the
+// same time. Requests for unknown or other streams' sessions are ignored.
+func (p *playlist) trackPlayhead(ctx context.Context, sid, streamID string, rc recordedChunk) {
+	sess, err := p.sessions.Get(ctx, sid)
+	if err != nil || sess.StreamID == "" {
+		return
+	}
+	switch {
+	case sess.StreamID == streamID:
+	case strings.HasPrefix(streamID, sess.StreamID+"/"):
+		pc, ok := p.indexer.ChunkAt(sess.StreamID, rc.FetchedAt, time.Duration(rc.Duration*float64(time.Second)/2))
+		if !ok {
+			return
+		}
+		rc = pc
+	default:
+		return
+	}
+	if err := p.sessions.SetPlayhead(ctx, sid, rc.Sequence); err != nil {
+		p.l.WithError(err).Error("saving playhead")
+	}
+}
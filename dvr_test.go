@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestDVRWindow(t *testing.T) {
+	ctx := context.Background()
+	idx := newChunkIndex()
+	t0 := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	for i := range 100 {
+		if err := idx.RecordChunk(ctx, "s", fmt.Sprintf("chunk-%d.ts", i+1), 10, t0.Add(time.Duration(i)*10*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pl := newPlaylist(logrus.New(), nil, idx, nil, newHLSSessions())
+
+	live, err := idx.Chunks(ctx, "s", 80, serveChunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seqs := func(rcs []recordedChunk) (int, int) {
+		return rcs[0].Sequence, rcs[len(rcs)-1].Sequence
+	}
+
+	sess := sessionData{StreamID: "s"}
+	w, err := pl.dvrWindow(ctx, &sess, live, 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, last := seqs(w); first != 68 || last != 82 {
+		t.Errorf("want window 68-82, got %d-%d", first, last)
+	}
+
+	// a player seeked back beyond the window keeps its segments, up to twice
+	// the window.
+	sess.PlayheadSequence = 60
+	w, _ = pl.dvrWindow(ctx, &sess, live, 2*time.Minute)
+	if first, _ := seqs(w); first != 60 {
+		t.Errorf("want window stretched to 60, got %d", first)
+	}
+	sess.PlayheadSequence = 10
+	w, _ = pl.dvrWindow(ctx, &sess, live, 2*time.Minute)
+	if first, _ := seqs(w); first != 56 {
+		t.Errorf("want window capped at 56, got %d", first)
+	}
+
+	// nothing from before the last jump
+	sess = sessionData{StreamID: "s", LatestSequence: 80, SequenceShift: 5, Discontinuities: []int{80}}
+	w, _ = pl.dvrWindow(ctx, &sess, live, 2*time.Minute)
+	if first, _ := seqs(w); first != 75 {
+		t.Errorf("want window to start at the jump to 75, got %d", first)
+	}
+}
+
+func TestPlayheadSurvivesSessionSave(t *testing.T) {
+	ctx := context.Background()
+	_, addr := startFakeRedis(t, "")
+	for name, store := range map[string]sessionStore{
+		"memory": newHLSSessions(),
+		"redis":  newRedisSessions(newRedisClient(addr, "", 0), time.Hour),
+	} {
+		t.Run(name, func(t *testing.T) {
+			sid, err := store.Create(ctx, sessionData{StreamID: "s", LatestSequence: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a playlist poll loads the session, a chunk fetch moves the
+			// playhead, then the poll saves what it loaded.
+			sess, err := store.Get(ctx, sid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.SetPlayhead(ctx, sid, 42); err != nil {
+				t.Fatal(err)
+			}
+			sess.LatestSequence = 11
+			if err := store.Set(ctx, sid, sess); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.Get(ctx, sid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.PlayheadSequence != 42 || got.LatestSequence != 11 {
+				t.Errorf("want playhead 42 kept and sequence 11 saved, got %d and %d", got.PlayheadSequence, got.LatestSequence)
+			}
+		})
+	}
+}
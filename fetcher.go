@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/etherlabsio/go-m3u8/m3u8"
@@ -22,30 +29,119 @@ type fetcher struct {
 	hc *http.Client
 	cs *stationChunkStore
 
-	url      *url.URL
 	streamID string
 
+	// sources are where the stream can be fetched from, in order of
+	// preference, and source is the one in use.
+	sources  []*url.URL
+	source   int
+	failover failoverConfig
+	// failures counts polls of the source in a row that failed. switchedAt
+	// is when we moved to the source or last found the first still down, and
+	// progressAt when we last recorded a new segment.
+	failures               int
+	switchedAt, progressAt time.Time
+	// switched is set for the first poll after moving source, to check the
+	// new one numbers its segments like the last.
+	switched bool
+
+	health fetchHealthConfig
+	// pollErrors counts polls in a row that failed on any source, to back off
+	// by. segmentErrors counts problems recording from the last poll, and
+	// stalled is set if its media sequence had stopped moving.
+	pollErrors    int
+	segmentErrors int
+	stalled       bool
+	statusMu      sync.Mutex
+	status        fetcherStatus
+
+	// recordVariants records every variant of a master playlist, or those
+	// in recordBandwidths if set, rather than only the best.
+	recordVariants   bool
+	recordBandwidths []int
+	// variantCfg picks the variant of a master playlist to record, and
+	// variant is the one picked, see pinVariant. It's kept in the store, and
+	// variantLoaded is set once it has been read back from there.
+	variantCfg    variantConfig
+	variant       string
+	variantLoaded bool
+
 	stopC  chan struct{}
 	ticker *time.Ticker
+
+	rec *recording
+	// variants are the recordings of each variant, by sub-stream id.
+	variants map[string]*recording
+}
+
+// recentSegments is how many segment hashes a recording keeps, enough to
+// cover the overlap between sources' playlists.
+const recentSegments = 32
+
+// recording is a media playlist being recorded in to a stream.
+type recording struct {
+	cs *stationChunkStore
+	// lastSeq is the source media sequence of the last segment we have, -1
+	// if we don't know. A segment that doesn't follow it is a discontinuity,
+	// and one before it has already been recorded from another source.
+	lastSeq int
+	// recent are hashes of the last segments recorded, to spot one turning
+	// up again from another source under a different name.
+	recent [][sha256.Size]byte
+	// seq is the media sequence of the playlist last fetched, and seqAt when
+	// it was first seen.
+	seq   int
+	seqAt time.Time
 }
 
-func newFetcher(l logrus.FieldLogger, cs *stationChunkStore, streamID, streamURL string) (*fetcher, error) {
+// seen reports if a segment with this hash was recorded recently.
+func (r *recording) seen(sum [sha256.Size]byte) bool {
+	return slices.Contains(r.recent, sum)
+}
+
+// remember notes the hash of a segment once it's recorded.
+func (r *recording) remember(sum [sha256.Size]byte) {
+	r.recent = append(r.recent, sum)
+	if len(r.recent) > recentSegments {
+		r.recent = r.recent[1:]
+	}
+}
+
+func newRecording(cs *stationChunkStore) *recording {
+	return &recording{cs: cs, lastSeq: -1}
+}
+
+func newFetcher(l logrus.FieldLogger, cs *stationChunkStore, s configStream) (*fetcher, error) {
 	hc := &http.Client{
 		Timeout: time.Second * 5,
 	}
 
-	u, err := url.Parse(streamURL)
-	if err != nil {
-		return nil, fmt.Errorf("parsing %s: %v", streamURL, err)
+	var sources []*url.URL
+	for _, su := range s.sources() {
+		u, err := url.Parse(su)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", su, err)
+		}
+		sources = append(sources, u)
 	}
 
+	setFetcherStateMetric(s.ID, fetcherHealthy)
+
 	return &fetcher{
-		l:        l,
-		hc:       hc,
-		url:      u,
-		streamID: streamID,
-		cs:       cs,
-		stopC:    make(chan struct{}),
+		l:                l,
+		hc:               hc,
+		sources:          sources,
+		failover:         s.Failover,
+		health:           s.Health,
+		status:           fetcherStatus{StreamID: s.ID, State: fetcherHealthy, Since: time.Now(), Source: sources[0].String()},
+		streamID:         s.ID,
+		cs:               cs,
+		recordVariants:   s.RecordVariants,
+		recordBandwidths: s.RecordBandwidths,
+		variantCfg:       s.Variant,
+		stopC:            make(chan struct{}),
+		rec:              newRecording(cs),
+		variants:         make(map[string]*recording),
 	}, nil
 }
 
@@ -55,6 +151,7 @@ func (f *fetcher) Run() error {
 	// set the initial ticker to fire immeditely. We'll reset it once inspecting
 	// the playlist we got
 	f.ticker = time.NewTicker(1 * time.Nanosecond)
+	f.switchedAt, f.progressAt = time.Now(), time.Now()
 
 	for {
 		select {
@@ -62,33 +159,34 @@ func (f *fetcher) Run() error {
 			f.l.Debug("tick")
 
 			// we don't hard error in here, assume we will retry/recover
-			pl, plurl, err := f.getPlaylist(f.url)
+			src := f.source
+			td, err := f.poll()
+			now := time.Now()
+			f.checkSource(err, now)
+
+			var rsd time.Duration
 			if err != nil {
 				fetchErrorCount.WithLabelValues(f.streamID).Inc()
 				f.l.WithError(err).Warn("getting playlist")
-				continue
-			}
-
-			var td time.Duration
-
-			for _, s := range pl.Segments() {
-				if err := f.downloadSegment(plurl, s); err != nil {
-					fetchErrorCount.WithLabelValues(f.streamID).Inc()
-					f.l.WithError(err).Warn("downloading segment")
-					continue
+				f.pollErrors++
+				rsd = fetchBackoff(f.pollErrors, f.health.MaxBackoff)
+				if f.source != src {
+					// give the source we moved to a go straight away
+					rsd = fetchBackoffBase
+				}
+			} else {
+				f.pollErrors = 0
+				// set the next fetch for when ~75% of this fetch is up. that
+				// should give us time to fetch/retry without being aggressive.
+				rsd = time.Duration(float64(td) * 0.75)
+				if rsd < 1 {
+					// we probably downloaded no chunks. Cannot reset a ticker
+					// to 0 and probably want to wait before retrying anyway,
+					// so reset to like 5s.
+					rsd = 5 * time.Second
 				}
-				td = td + time.Duration(s.Duration*float64(time.Second))
-			}
-
-			// set the next fetch for when ~75% of this fetch is up. that should
-			// give us time to fetch/retry without being aggressive.
-			rsd := time.Duration(float64(td) * 0.75)
-			if rsd < 1 {
-				// we probably downloaded no chunks. Cannot reset a ticker to 0
-				// and probably want to wait before retrying anyway, so reset to
-				// like 5s.
-				rsd = 5 * time.Second
 			}
+			f.updateStatus(now, err, rsd)
 			f.l.Debugf("Resetting ticker to interval %s", rsd)
 			f.ticker.Reset(rsd)
 		case <-f.stopC:
@@ -101,7 +199,173 @@ func (f *fetcher) Interrupt(_ error) {
 	f.stopC <- struct{}{}
 }
 
-func (f *fetcher) getPlaylist(u *url.URL) (*m3u8.Playlist, *url.URL, error) {
+// poll fetches the current source's playlist and records new segments from
+// it, returning their duration. It only fails if the playlist can't be got.
+func (f *fetcher) poll() (time.Duration, error) {
+	f.segmentErrors, f.stalled = 0, false
+	pl, plurl, err := f.readPlaylist(f.sources[f.source])
+	if err != nil {
+		return 0, err
+	}
+	defer func() { f.switched = false }()
+	if pl.IsMaster() && f.recordVariants {
+		return f.recordVariantPlaylists(pl, plurl), nil
+	}
+	if pl.IsMaster() {
+		pl, plurl, err = f.followMaster(pl, plurl)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return f.record(f.rec, pl, plurl), nil
+}
+
+// checkSource moves to another source if the current one has failed too many
+// times in a row, or hasn't given us anything new for too long. If we're on
+// a backup for long enough, it fails back to the first.
+func (f *fetcher) checkSource(pollErr error, now time.Time) {
+	if len(f.sources) < 2 {
+		return
+	}
+	next := (f.source + 1) % len(f.sources)
+	if pollErr != nil {
+		f.failures++
+		if f.failures >= f.failover.Failures {
+			f.switchSource(next, now, fmt.Sprintf("%d failures in a row", f.failures))
+		}
+		return
+	}
+	f.failures = 0
+	switch {
+	case now.Sub(f.progressAt) > f.failover.Stale:
+		f.switchSource(next, now, fmt.Sprintf("no new segments for %s", now.Sub(f.progressAt).Round(time.Second)))
+	case f.source != 0 && f.failover.Failback > 0 && now.Sub(f.switchedAt) >= f.failover.Failback:
+		if err := f.probe(f.sources[0]); err != nil {
+			f.l.WithError(err).Infof("not failing back, %s is still unavailable", f.sources[0])
+			f.switchedAt = now
+			return
+		}
+		f.switchSource(0, now, fmt.Sprintf("failing back after %s", f.failover.Failback))
+	}
+}
+
+// probe checks a source's playlist can be got and has something in it,
+// without recording from it.
+func (f *fetcher) probe(u *url.URL) error {
+	pl, _, err := f.readPlaylist(u)
+	if err != nil {
+		return err
+	}
+	if !pl.IsMaster() && pl.SegmentSize() == 0 {
+		return errors.New("playlist has no segments")
+	}
+	return nil
+}
+
+func (f *fetcher) switchSource(i int, now time.Time, reason string) {
+	f.l.Warnf("moving from source %s to %s: %s", f.sources[f.source], f.sources[i], reason)
+	fetchFailoverCount.WithLabelValues(f.streamID).Inc()
+	f.source, f.failures, f.switched = i, 0, true
+	f.switchedAt, f.progressAt = now, now
+}
+
+// record downloads the segments of a media playlist we don't have yet,
+// returning the duration of those it got.
+func (f *fetcher) record(rec *recording, pl *m3u8.Playlist, plurl *url.URL) time.Duration {
+	now := time.Now()
+	if rec.stalled(pl, now, f.health.StallTargetDurations) {
+		f.l.Debugf("media sequence has been %d since %s", rec.seq, rec.seqAt.Format(time.RFC3339))
+		f.stalled = true
+	}
+	segs := playlistSegments(f.l, pl, now)
+	if n := len(segs); f.switched && n > 0 && rec.lastSeq >= 0 {
+		first, last := segs[0].Sequence, segs[n-1].Sequence
+		if rec.lastSeq < first-n || rec.lastSeq > last+n {
+			f.l.Warnf("source %s has sequences %d to %d but we're up to %d, it doesn't number segments like the last source so only identical segments are skipped", f.sources[f.source], first, last, rec.lastSeq)
+		}
+	}
+	// sequences going back further than the playlist covers aren't a
+	// source behind the others, it started numbering again.
+	if n := len(segs); n > 0 && rec.lastSeq >= 0 && segs[n-1].Sequence+n < rec.lastSeq {
+		f.l.Warnf("source media sequence went back from %d to %d, starting a new run", rec.lastSeq, segs[n-1].Sequence)
+		rec.lastSeq = -1
+	}
+	var td time.Duration
+	for _, seg := range segs {
+		if err := f.downloadSegment(rec, plurl, seg); err != nil {
+			f.segmentErrors++
+			fetchErrorCount.WithLabelValues(f.streamID).Inc()
+			f.l.WithError(err).Warn("downloading segment")
+			continue
+		}
+		td = td + time.Duration(seg.Duration*float64(time.Second))
+	}
+	return td
+}
+
+// recordVariantPlaylists records each variant of a master playlist we want in
+// to its own sub-stream. It returns the shortest duration got for a variant,
+// so the next fetch is soon enough for all of them.
+func (f *fetcher) recordVariantPlaylists(pl *m3u8.Playlist, plurl *url.URL) time.Duration {
+	var (
+		vs []streamVariant
+		td time.Duration
+	)
+	for _, sv := range f.variantCfg.match(pl) {
+		if len(f.recordBandwidths) > 0 && !slices.Contains(f.recordBandwidths, sv.Bandwidth) {
+			continue
+		}
+		var codecs string
+		if sv.Codecs != nil {
+			codecs = *sv.Codecs
+		}
+		// renditions can share a bandwidth, e.g. the same bitrate in two
+		// codecs, so they're numbered to keep them apart.
+		var n int
+		for _, o := range vs {
+			if o.Bandwidth == sv.Bandwidth {
+				n++
+			}
+		}
+		v := newStreamVariant(f.streamID, sv.Bandwidth, n, codecs)
+		vs = append(vs, v)
+
+		rec, ok := f.variants[v.ID]
+		if !ok {
+			rec = newRecording(f.cs.variant(v))
+			f.variants[v.ID] = rec
+		}
+		u, err := resolveSegmentURL(plurl, sv.PlaylistURI())
+		if err != nil {
+			f.segmentErrors++
+			fetchErrorCount.WithLabelValues(f.streamID).Inc()
+			f.l.WithError(err).Warnf("resolving playlist url for variant %s", v.Name)
+			continue
+		}
+		vpl, vplurl, err := f.readPlaylist(u)
+		if err == nil && vpl.IsMaster() {
+			err = fmt.Errorf("%s is a master playlist", vplurl)
+		}
+		if err != nil {
+			f.segmentErrors++
+			fetchErrorCount.WithLabelValues(f.streamID).Inc()
+			f.l.WithError(err).Warnf("getting playlist for variant %s", v.Name)
+			continue
+		}
+		if d := f.record(rec, vpl, vplurl); d > 0 && (td == 0 || d < td) {
+			td = d
+		}
+	}
+	if len(vs) == 0 {
+		f.l.Warn("no variants to record in the master playlist")
+	}
+	f.cs.SetVariants(vs)
+	return td
+}
+
+// readPlaylist fetches and parses the playlist at u. It also returns the URL
+// it ended up at, after redirects.
+func (f *fetcher) readPlaylist(u *url.URL) (*m3u8.Playlist, *url.URL, error) {
 	r, err := f.hc.Get(u.String())
 	if err != nil {
 		return nil, nil, err
@@ -115,33 +379,155 @@ func (f *fetcher) getPlaylist(u *url.URL) (*m3u8.Playlist, *url.URL, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("reading playlist from %s: %v", u.String(), err)
 	}
+	return pl, r.Request.URL, nil
+}
 
+// getPlaylist returns the media playlist at u, following master playlists.
+func (f *fetcher) getPlaylist(u *url.URL) (*m3u8.Playlist, *url.URL, error) {
+	pl, plurl, err := f.readPlaylist(u)
+	if err != nil {
+		return nil, nil, err
+	}
 	if pl.IsMaster() {
-		// master playlist links others...
-		var best *m3u8.PlaylistItem
-		for _, i := range pl.Items {
-			if i, ok := i.(*m3u8.PlaylistItem); ok {
-				if best == nil || i.Bandwidth > best.Bandwidth {
-					best = i
-				}
+		return f.followMaster(pl, plurl)
+	}
+	return pl, plurl, nil
+}
+
+// followMaster returns the media playlist of the variant we record from a
+// master playlist.
+func (f *fetcher) followMaster(pl *m3u8.Playlist, plurl *url.URL) (*m3u8.Playlist, *url.URL, error) {
+	// master playlist links others...
+	v, err := f.pinVariant(f.variantCfg.match(pl))
+	if err != nil {
+		return nil, nil, err
+	}
+	f.l.Debugf("%s is a master playlist, using variant %s", plurl.String(), v)
+	// recurse to get the actual items we want
+	u, err := resolveSegmentURL(plurl, v.PlaylistURI())
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolving playlist url %s: %w", v.PlaylistURI(), err)
+	}
+	return f.getPlaylist(u)
+}
+
+// pinVariant picks the variant to record out of those matched. Once one is
+// picked it sticks while the source still has it, so the recording doesn't
+// change quality halfway through if the source reorders or adds variants. The
+// pick is stored, so it sticks across restarts too.
+func (f *fetcher) pinVariant(vs []sourceVariant) (sourceVariant, error) {
+	pick, ok := f.variantCfg.pick(vs)
+	if !ok {
+		return sourceVariant{}, errors.New("can't find a variant to record in the master playlist")
+	}
+	if !f.variantLoaded {
+		v, err := f.cs.PinnedVariant(context.TODO())
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			// don't replace the pin with a fresh pick, try again next poll
+			return sourceVariant{}, fmt.Errorf("reading pinned variant: %w", err)
+		}
+		f.variant, f.variantLoaded = v, true
+	}
+	prev := f.variant
+	switch {
+	case f.variant == "":
+		f.l.Infof("recording variant %s", pick)
+	case pick.String() == f.variant:
+	default:
+		for _, v := range vs {
+			if v.String() == f.variant {
+				f.l.Debugf("staying on variant %s, %s would be picked now", v, pick)
+				return v, nil
 			}
 		}
-		if best == nil {
-			return nil, nil, errors.New("can't find anything in the master playlist")
+		f.l.Warnf("variant %s is no longer in the master playlist, switching to %s", f.variant, pick)
+		// the new variant's segments don't follow on from the old ones
+		f.rec.lastSeq = -1
+	}
+	f.variant = pick.String()
+	if f.variant != prev {
+		if err := f.cs.SetPinnedVariant(context.TODO(), f.variant); err != nil {
+			f.l.WithError(err).Warn("storing pinned variant")
 		}
-		f.l.Debugf("%s is a master playlist, using entry with bandwidth %d", u.String(), best.Bandwidth)
-		// recurse to get the actual items we want
-		u, err := resolveSegmentURL(r.Request.URL, best.URI)
-		if err != nil {
-			return nil, nil, fmt.Errorf("resolving playlist url %s: %w", best.URI, err)
+	}
+	return pick, nil
+}
+
+// maxProgramDateTimeSkew is how far the source's EXT-X-PROGRAM-DATE-TIME can
+// put the live edge from our clock before we stop believing it.
+const maxProgramDateTimeSkew = time.Minute
+
+// sourceSegment is a segment in the source's media playlist.
+type sourceSegment struct {
+	*m3u8.SegmentItem
+	// Sequence is the segment's media sequence number in the source.
+	Sequence int
+	// Discontinuity is set if the source marked the segment as one.
+	Discontinuity bool
+	// Start is when the segment started in broadcast time.
+	Start time.Time
+}
+
+// playlistSegments returns the segments in a media playlist fetched at now.
+// They are timed from EXT-X-PROGRAM-DATE-TIME if the source has it, otherwise
+// back-dated from their position, taking the last segment to end at now.
+func playlistSegments(l logrus.FieldLogger, pl *m3u8.Playlist, now time.Time) []sourceSegment {
+	var (
+		out  []sourceSegment
+		disc bool
+		pdt  *m3u8.TimeItem
+	)
+	for _, it := range pl.Items {
+		switch it := it.(type) {
+		case *m3u8.DiscontinuityItem:
+			disc = true
+		case *m3u8.TimeItem:
+			// the tag usually comes before EXTINF, so is read as its own
+			// item rather than onto the segment.
+			pdt = it
+		case *m3u8.SegmentItem:
+			seg := sourceSegment{SegmentItem: it, Sequence: pl.Sequence + len(out), Discontinuity: disc}
+			if it.ProgramDateTime != nil {
+				pdt = it.ProgramDateTime
+			}
+			if pdt != nil {
+				seg.Start = pdt.Time
+			} else if len(out) > 0 && !out[len(out)-1].Start.IsZero() {
+				prev := out[len(out)-1]
+				seg.Start = prev.Start.Add(time.Duration(prev.Duration * float64(time.Second)))
+			}
+			out = append(out, seg)
+			disc, pdt = false, nil
 		}
-		return f.getPlaylist(u)
+	}
+	if len(out) == 0 {
+		return nil
 	}
 
-	return pl, r.Request.URL, nil
+	// segments before the first EXT-X-PROGRAM-DATE-TIME run up to it. If
+	// there are none, or they're too far out to be right, run up to now.
+	last := out[len(out)-1]
+	end := last.Start.Add(time.Duration(last.Duration * float64(time.Second)))
+	if last.Start.IsZero() || end.Sub(now).Abs() > maxProgramDateTimeSkew {
+		if !last.Start.IsZero() {
+			l.Debugf("source program date time puts the live edge at %s, more than %s from now, ignoring it", end, maxProgramDateTimeSkew)
+		}
+		for i := range out {
+			out[i].Start = time.Time{}
+		}
+		end = now
+	}
+	for i := len(out) - 1; i >= 0; i-- {
+		if out[i].Start.IsZero() {
+			out[i].Start = end.Add(-time.Duration(out[i].Duration * float64(time.Second)))
+		}
+		end = out[i].Start
+	}
+	return out
 }
 
-func (f *fetcher) downloadSegment(playlistURL *url.URL, s *m3u8.SegmentItem) error {
+// downloadSegment records the segment in rec, if we don't have it already.
+func (f *fetcher) downloadSegment(rec *recording, playlistURL *url.URL, s sourceSegment) error {
 	segmentURL, err := resolveSegmentURL(playlistURL, s.Segment)
 	if err != nil {
 		return err
@@ -152,11 +538,28 @@ func (f *fetcher) downloadSegment(playlistURL *url.URL, s *m3u8.SegmentItem) err
 		return err
 	}
 
-	if f.cs.ChunkExists(context.TODO(), cn) {
+	if rec.cs.ChunkExists(context.TODO(), cn) {
 		f.l.Debugf("chunk %s exists, skipping", cn)
+		rec.lastSeq = s.Sequence
+		return nil
+	}
+	// sources number the same segments the same, so one we're past has
+	// already come from another.
+	if rec.lastSeq >= 0 && s.Sequence <= rec.lastSeq {
+		f.l.Debugf("chunk %s (sequence %d) already recorded up to sequence %d, skipping", cn, s.Sequence, rec.lastSeq)
 		return nil
 	}
 
+	// missing the segment before this one means there's a hole in the
+	// recording, e.g. we were down or couldn't reach the source for longer
+	// than its playlist covers. The first segment we record doesn't need
+	// marking.
+	disc := s.Discontinuity
+	if rec.lastSeq != s.Sequence-1 && !rec.cs.Empty() {
+		f.l.Infof("chunk %s (sequence %d) doesn't follow on from sequence %d, marking discontinuity", cn, s.Sequence, rec.lastSeq)
+		disc = true
+	}
+
 	f.l.Debugf("downloading chunk %s from %s", cn, segmentURL.String())
 	r, err := f.hc.Get(segmentURL.String())
 	if err != nil {
@@ -167,13 +570,35 @@ func (f *fetcher) downloadSegment(playlistURL *url.URL, s *m3u8.SegmentItem) err
 		return fmt.Errorf("wanted 200 from %s, got: %d", segmentURL.String(), r.StatusCode)
 	}
 
-	if err := f.cs.WriteChunk(context.TODO(), cn, s.Duration, r.Body); err != nil {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", segmentURL.String(), err)
+	}
+	sum := sha256.Sum256(body)
+	if rec.seen(sum) {
+		f.l.Debugf("chunk %s is the same as one already recorded, skipping", cn)
+		rec.lastSeq = s.Sequence
+		return nil
+	}
+
+	if err := rec.cs.WriteChunk(context.TODO(), cn, s.Start, s.Duration, segmentTitle(s.SegmentItem), disc, bytes.NewReader(body)); err != nil {
 		return fmt.Errorf("writing chunk: %v", err)
 	}
+	rec.remember(sum)
+	rec.lastSeq = s.Sequence
+	f.progressAt = time.Now()
 
 	return nil
 }
 
+// segmentTitle returns the title from a segment's EXTINF line, if it has one.
+func segmentTitle(s *m3u8.SegmentItem) string {
+	if s.Comment == nil {
+		return ""
+	}
+	return strings.TrimSpace(*s.Comment)
+}
+
 func resolveSegmentURL(playlistURL *url.URL, segment string) (*url.URL, error) {
 	segmentURL, err := url.Parse(segment)
 	if err != nil {
@@ -1,8 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"path"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/etherlabsio/go-m3u8/m3u8"
+	"github.com/sirupsen/logrus"
 )
 
 func TestResolveSegmentURL(t *testing.T) {
@@ -29,3 +40,368 @@ func TestResolveSegmentURL(t *testing.T) {
 		t.Errorf("should resolve to https://server/stream/file.aac , got: %s", res.String())
 	}
 }
+
+func TestPlaylistSegments(t *testing.T) {
+	now := time.Date(2026, 4, 7, 12, 0, 0, 0, time.UTC)
+	read := func(s string) *m3u8.Playlist {
+		t.Helper()
+		pl, err := m3u8.Read(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pl
+	}
+	starts := func(segs []sourceSegment) []string {
+		var out []string
+		for _, s := range segs {
+			out = append(out, fmt.Sprintf("%d:%s:%t", s.Sequence, s.Start.Format("15:04:05"), s.Discontinuity))
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		Playlist string
+		Want     []string
+	}{
+		{
+			Name: "Back-dated",
+			Playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:100
+#EXTINF:10,
+a.aac
+#EXTINF:10,
+b.aac
+#EXT-X-DISCONTINUITY
+#EXTINF:5,
+c.aac
+`,
+			Want: []string{"100:11:59:35:false", "101:11:59:45:false", "102:11:59:55:true"},
+		},
+		{
+			Name: "Program date time",
+			Playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:100
+#EXTINF:10,
+a.aac
+#EXT-X-PROGRAM-DATE-TIME:2026-04-07T11:59:30Z
+#EXTINF:10,
+b.aac
+#EXTINF:10,
+c.aac
+`,
+			// a.aac runs up to the first date, the rest follow on from it
+			Want: []string{"100:11:59:20:false", "101:11:59:30:false", "102:11:59:40:false"},
+		},
+		{
+			Name: "Program date time too far out",
+			Playlist: `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:100
+#EXT-X-PROGRAM-DATE-TIME:2026-04-07T09:00:00Z
+#EXTINF:10,
+a.aac
+#EXTINF:10,
+b.aac
+`,
+			Want: []string{"100:11:59:40:false", "101:11:59:50:false"},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			got := starts(playlistSegments(logrus.New(), read(tc.Playlist), now))
+			if fmt.Sprint(got) != fmt.Sprint(tc.Want) {
+				t.Errorf("want %v, got %v", tc.Want, got)
+			}
+		})
+	}
+}
+
+func TestFetcherRecordsVariants(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=48000,CODECS="mp4a.40.5"
+lo/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS="mp4a.40.2"
+hi/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS="mp4a.40.5"
+hihe/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=320000,CODECS="mp4a.40.2"
+best/index.m3u8
+`)
+	})
+	for _, v := range []string{"lo", "hi", "hihe", "best"} {
+		mux.HandleFunc("/"+v+"/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:7\n#EXTINF:10,\n"+v+"-7.aac\n#EXTINF:10,\n"+v+"-8.aac\n")
+		})
+		mux.HandleFunc("/"+v+"/", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.URL.Path)
+		})
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := configStream{ID: "s", URL: srv.URL + "/master.m3u8", RecordVariants: true, RecordBandwidths: []int{48000, 128000}}
+	f, err := newFetcher(logrus.New(), newStationChunkStore("s", fs, idx), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, plurl, err := f.readPlaylist(f.sources[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if td := f.recordVariantPlaylists(pl, plurl); td != 20*time.Second {
+		t.Errorf("want 20s recorded, got %s", td)
+	}
+
+	if subs := idx.SubStreams("s"); fmt.Sprint(subs) != "[s/128000 s/128000-2 s/48000]" {
+		t.Errorf("want the configured variants recorded, got %v", subs)
+	}
+	if _, ok := idx.GetChunk("s/128000-2", "hihe-8.aac"); !ok {
+		t.Error("want the second 128000 variant recorded on its own")
+	}
+	if _, ok := idx.GetChunk("s/48000", "lo-8.aac"); !ok {
+		t.Error("want lo-8.aac recorded in the 48000 variant")
+	}
+	vs := idx.Variants("s")
+	if len(vs) != 3 || vs[0].Name != "128000" || vs[0].Codecs != "mp4a.40.2" || vs[1].Name != "128000-2" || vs[1].Codecs != "mp4a.40.5" {
+		t.Errorf("want variants with their codecs, got %v", vs)
+	}
+	if _, ok := idx.GetChunk("s", "hi-7.aac"); !ok {
+		t.Error("want the stream to read from the highest recorded variant")
+	}
+
+	// and they're found again on restart
+	idx = newChunkIndex()
+	fs.idx = idx
+	if err := fs.LoadStream(context.Background(), "s"); err != nil {
+		t.Fatal(err)
+	}
+	if subs := idx.SubStreams("s"); fmt.Sprint(subs) != "[s/128000 s/128000-2 s/48000]" {
+		t.Errorf("want the variants loaded from the store, got %v", subs)
+	}
+}
+
+func TestFetcherFailover(t *testing.T) {
+	var primaryDown bool
+	serve := func(name string, down *bool) *httptest.Server {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			if down != nil && *down {
+				http.Error(w, "down", http.StatusBadGateway)
+				return
+			}
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:7\n#EXTINF:10,\n"+name+"-7.aac\n#EXTINF:10,\n"+name+"-8.aac\n")
+		})
+		// both sources serve the same audio
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, strings.TrimPrefix(r.URL.Path, "/"+name))
+		})
+		return httptest.NewServer(mux)
+	}
+	primary, backup := serve("primary", &primaryDown), serve("backup", nil)
+	defer primary.Close()
+	defer backup.Close()
+
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := configStream{
+		ID:       "s",
+		URL:      primary.URL + "/index.m3u8",
+		URLs:     []string{backup.URL + "/index.m3u8"},
+		Failover: failoverConfig{Failures: 2, Stale: time.Minute, Failback: 10 * time.Minute},
+	}
+	f, err := newFetcher(logrus.New(), newStationChunkStore("s", fs, idx), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	f.switchedAt, f.progressAt = now, now
+
+	poll := func() error {
+		t.Helper()
+		_, err := f.poll()
+		f.checkSource(err, now)
+		return err
+	}
+
+	if err := poll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx.GetChunk("s", "primary-8.aac"); !ok {
+		t.Fatal("want primary-8.aac recorded")
+	}
+
+	primaryDown = true
+	for range 2 {
+		if err := poll(); err == nil {
+			t.Fatal("want the primary to fail")
+		}
+	}
+	if f.source != 1 {
+		t.Fatal("want to fail over to the backup after 2 failures")
+	}
+
+	// the backup has the same segments under other names, which aren't
+	// recorded again.
+	if err := poll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx.GetChunk("s", "backup-8.aac"); ok {
+		t.Error("want the backup's copy of a recorded segment skipped")
+	}
+
+	// once it's stopped giving us anything new, we move on.
+	now = now.Add(2 * time.Minute)
+	if err := poll(); err != nil {
+		t.Fatal(err)
+	}
+	if f.source != 0 {
+		t.Error("want to move back to the primary when the backup is stale")
+	}
+
+	// failback waits for the primary to come back
+	f.source, f.switchedAt, f.progressAt = 1, now, now
+	now = now.Add(10 * time.Minute)
+	f.progressAt = now
+	if err := poll(); err != nil {
+		t.Fatal(err)
+	}
+	if f.source != 1 || !f.switchedAt.Equal(now) {
+		t.Error("want to stay on the backup while the primary is down")
+	}
+
+	primaryDown = false
+	now = now.Add(10 * time.Minute)
+	f.progressAt = now
+	if err := poll(); err != nil {
+		t.Fatal(err)
+	}
+	if f.source != 0 {
+		t.Error("want to fail back to the primary")
+	}
+}
+
+func TestRecordingDedupe(t *testing.T) {
+	mux := http.NewServeMux()
+	var playlist string
+	mux.HandleFunc("/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, playlist)
+	})
+	// x-a.aac has the same audio as a.aac
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		if _, after, ok := strings.Cut(name, "-"); ok {
+			name = after
+		}
+		fmt.Fprint(w, name)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFetcher(logrus.New(), newStationChunkStore("s", fs, idx), configStream{ID: "s", URL: srv.URL + "/index.m3u8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(pl string) {
+		t.Helper()
+		playlist = pl
+		if _, err := f.poll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:100\n#EXTINF:10,\na.aac\n#EXTINF:10,\nb.aac\n")
+	// another source numbering the same segments the same
+	record("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:100\n#EXTINF:10,\nx-a.aac\n#EXTINF:10,\nx-b.aac\n#EXTINF:10,\nx-c.aac\n")
+	if _, ok := idx.GetChunk("s", "x-a.aac"); ok {
+		t.Error("want a segment at a recorded sequence skipped")
+	}
+	if _, ok := idx.GetChunk("s", "x-c.aac"); !ok {
+		t.Error("want the new segment recorded")
+	}
+
+	// and one numbering them differently
+	record("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:300\n#EXTINF:10,\ny-c.aac\n#EXTINF:10,\ny-e.aac\n")
+	if _, ok := idx.GetChunk("s", "y-c.aac"); ok {
+		t.Error("want a segment with recorded content skipped")
+	}
+	if _, ok := idx.GetChunk("s", "y-e.aac"); !ok {
+		t.Error("want the new segment recorded")
+	}
+
+	// the source starting its numbering again is a new run, not old segments
+	record("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:10,\nd.aac\n")
+	rc, ok := idx.GetChunk("s", "d.aac")
+	if !ok {
+		t.Fatal("want d.aac recorded after the sequence reset")
+	}
+	if !rc.Discontinuity {
+		t.Error("want the reset marked as a discontinuity")
+	}
+}
+
+// failingPutStore fails writes while fail is set.
+type failingPutStore struct {
+	chunkStore
+	fail bool
+}
+
+func (s *failingPutStore) PutObject(ctx context.Context, key string, body []byte) error {
+	if s.fail {
+		return errors.New("put failed")
+	}
+	return s.chunkStore.PutObject(ctx, key, body)
+}
+
+func TestFetcherRetriesFailedWrite(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:10,\na.aac\n")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &failingPutStore{chunkStore: fs, fail: true}
+	f, err := newFetcher(logrus.New(), newStationChunkStore("s", store, idx), configStream{ID: "s", URL: srv.URL + "/index.m3u8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if f.segmentErrors != 1 {
+		t.Errorf("want the failed write counted, got %d", f.segmentErrors)
+	}
+	store.fail = false
+	if _, err := f.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx.GetChunk("s", "a.aac"); !ok {
+		t.Error("want a.aac recorded once the store is back")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var (
+	_ chunkStore   = (*fsChunkStore)(nil)
+	_ objectLister = (*fsChunkStore)(nil)
+)
+
+// fsChunkStore keeps segments on the local filesystem, using the same object
+// key layout as S3 relative to root. Chunks are served directly by tjts.
+type fsChunkStore struct {
+	root string
+	idx  *chunkIndex
+}
+
+func newFSChunkStore(root string, idx *chunkIndex) (*fsChunkStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("creating %s: %w", root, err)
+	}
+	return &fsChunkStore{root: root, idx: idx}, nil
+}
+
+func (s *fsChunkStore) path(objectKey string) (string, error) {
+	p := filepath.FromSlash(objectKey)
+	if !filepath.IsLocal(p) {
+		return "", fmt.Errorf("invalid object key %q", objectKey)
+	}
+	return filepath.Join(s.root, p), nil
+}
+
+// LoadStream lists existing files for a stream and rebuilds the in-memory index.
+func (s *fsChunkStore) LoadStream(ctx context.Context, streamID string) error {
+	return loadStoredStream(ctx, s, s.idx, streamID)
+}
+
+// ListStreams lists the stream directories under root.
+func (s *fsChunkStore) ListStreams(_ context.Context) ([]string, error) {
+	des, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, fmt.Errorf("list streams: %w", err)
+	}
+	var ids []string
+	for _, de := range des {
+		if de.IsDir() && !isReserved(de.Name()) {
+			ids = append(ids, de.Name())
+		}
+	}
+	return ids, nil
+}
+
+// ListObjects lists the files under the stream's directory, including those of
+// sub-streams, using their modification time as LastModified.
+func (s *fsChunkStore) ListObjects(_ context.Context, streamID string) ([]storedObject, error) {
+	dir, err := s.path(streamID)
+	if err != nil {
+		return nil, err
+	}
+	var objs []storedObject
+	err = filepath.WalkDir(dir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !de.Type().IsRegular() {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", de.Name(), err)
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		objs = append(objs, storedObject{Key: streamID + "/" + filepath.ToSlash(rel), LastModified: fi.ModTime(), Size: fi.Size()})
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("list %s: %w", streamID, err)
+	}
+	return objs, nil
+}
+
+// RenameObject moves an object's file to a new key.
+func (s *fsChunkStore) RenameObject(_ context.Context, from, to string) error {
+	fp, err := s.path(from)
+	if err != nil {
+		return err
+	}
+	tp, err := s.path(to)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(tp), 0o755); err != nil {
+		return fmt.Errorf("rename %s to %s: %w", from, to, err)
+	}
+	if err := os.Rename(fp, tp); err != nil {
+		return fmt.Errorf("rename %s to %s: %w", from, to, err)
+	}
+	return nil
+}
+
+// PutObject writes the body to a temporary file and renames it in to place, so
+// a crash never leaves a partial segment behind under a valid key.
+func (s *fsChunkStore) PutObject(_ context.Context, objectKey string, body []byte) error {
+	p, err := s.path(objectKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("put %s: %w", objectKey, err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".put-*")
+	if err != nil {
+		return fmt.Errorf("put %s: %w", objectKey, err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		return fmt.Errorf("put %s: %w", objectKey, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("put %s: %w", objectKey, err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return fmt.Errorf("put %s: %w", objectKey, err)
+	}
+	return nil
+}
+
+// GetObject reads a file.
+func (s *fsChunkStore) GetObject(_ context.Context, objectKey string) ([]byte, error) {
+	p, err := s.path(objectKey)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", objectKey, err)
+	}
+	return b, nil
+}
+
+// GetObjectReader opens the file for a chunk.
+func (s *fsChunkStore) GetObjectReader(_ context.Context, rc recordedChunk) (io.ReadCloser, error) {
+	p, err := s.path(rc.ObjectKey)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", rc.ObjectKey, err)
+	}
+	return f, nil
+}
+
+// ServeChunk serves the chunk file directly, there is nothing to redirect to.
+func (s *fsChunkStore) ServeChunk(w http.ResponseWriter, r *http.Request, rc recordedChunk) error {
+	p, err := s.path(rc.ObjectKey)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("get %s: %w", rc.ObjectKey, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", rc.ObjectKey, err)
+	}
+	serveChunkContent(w, r, rc, fi.ModTime(), f)
+	return nil
+}
+
+// DeleteObject removes the file for an object. Missing files are not an error,
+// matching S3 semantics.
+func (s *fsChunkStore) DeleteObject(_ context.Context, objectKey string) error {
+	p, err := s.path(objectKey)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("delete %s: %w", objectKey, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFSChunkStore(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	idx := newChunkIndex()
+	store, err := newFSChunkStore(root, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scs := newStationChunkStore("fs", store, idx)
+
+	for _, cid := range []string{"one.aac", "two.aac"} {
+		if err := scs.WriteChunk(ctx, cid, time.Now(), 10, "", false, strings.NewReader("body "+cid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !scs.ChunkExists(ctx, "one.aac") {
+		t.Error("one.aac should exist after write")
+	}
+
+	// a fresh index should be rebuilt from what is on disk
+	idx2 := newChunkIndex()
+	store2, err := newFSChunkStore(root, idx2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store2.LoadStream(ctx, "fs"); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := idx2.Chunks(ctx, "fs", 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 2 || cs[0].ChunkID != "one.aac" || cs[1].ChunkID != "two.aac" {
+		t.Fatalf("want one.aac, two.aac after load, got %#v", cs)
+	}
+
+	r, err := store2.GetObjectReader(ctx, cs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "body two.aac" {
+		t.Errorf("want body two.aac, got %q", string(b))
+	}
+
+	rec := httptest.NewRecorder()
+	if err := store2.ServeChunk(rec, httptest.NewRequest("GET", "/chunk", nil), cs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || rec.Body.String() != "body one.aac" {
+		t.Errorf("serve: want 200 body one.aac, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	if err := store2.DeleteObject(ctx, cs[0].ObjectKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store2.GetObjectReader(ctx, cs[0]); err == nil {
+		t.Error("deleted chunk should not be readable")
+	}
+	if err := store2.DeleteObject(ctx, cs[0].ObjectKey); err != nil {
+		t.Errorf("deleting a missing object should not error, got %v", err)
+	}
+
+	// sequences must survive a rebuild even once older chunks are gone
+	idx3 := newChunkIndex()
+	store3, err := newFSChunkStore(root, idx3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store3.LoadStream(ctx, "fs"); err != nil {
+		t.Fatal(err)
+	}
+	cs3, err := idx3.Chunks(ctx, "fs", 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs3) != 1 || cs3[0].Sequence != cs[1].Sequence {
+		t.Fatalf("want only %s with sequence %d after reload, got %#v", cs[1].ChunkID, cs[1].Sequence, cs3)
+	}
+
+	if err := store2.PutObject(ctx, "_sessions/x", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := store2.ListStreams(ctx); err != nil || len(ids) != 1 || ids[0] != "fs" {
+		t.Errorf("want only stream fs listed, got %v %v", ids, err)
+	}
+
+	if err := store2.PutObject(ctx, "../escape", nil); err == nil {
+		t.Error("keys outside the root should be rejected")
+	}
+}
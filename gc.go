@@ -3,18 +3,19 @@ package main
 import (
 	"context"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	gcInterval  = 1 * time.Hour
-	sessMaxAge  = 12 * time.Hour
-	chunkMaxAge = 24 * time.Hour
+// unconfiguredMaxAge is how long chunks are kept for streams that are stored
+// but no longer in the config, so dropping a stream doesn't leak its chunks.
+const unconfiguredMaxAge = defaultMaxOffset
 
-	expiredChunksMax = 1000
-)
+// expiredChunksMax caps the chunks deleted per stream in one run.
+const expiredChunksMax = 1000
 
 type objectDeleter interface {
 	DeleteObject(ctx context.Context, objectKey string) error
@@ -23,21 +24,25 @@ type objectDeleter interface {
 type garbageCollector struct {
 	l logrus.FieldLogger
 
-	idx     *chunkIndex
-	obj     objectDeleter
-	hlsSess *hlsSessions
+	idx      *chunkIndex
+	obj      objectDeleter
+	sessions sessionPruner
+	streams  []configStream
+	cfg      gcConfig
 
 	ticker *time.Ticker
 	stopC  chan struct{}
 }
 
-func newGarbageCollector(l logrus.FieldLogger, idx *chunkIndex, obj objectDeleter, hlsSess *hlsSessions) *garbageCollector {
+func newGarbageCollector(l logrus.FieldLogger, idx *chunkIndex, obj objectDeleter, sessions sessionPruner, streams []configStream, cfg gcConfig) *garbageCollector {
 	return &garbageCollector{
-		l:       l,
-		idx:     idx,
-		obj:     obj,
-		hlsSess: hlsSess,
-		stopC:   make(chan struct{}),
+		l:        l,
+		idx:      idx,
+		obj:      obj,
+		sessions: sessions,
+		streams:  streams,
+		cfg:      cfg,
+		stopC:    make(chan struct{}),
 	}
 }
 
@@ -46,7 +51,7 @@ func (g *garbageCollector) Run() error {
 		return err
 	}
 
-	g.ticker = time.NewTicker(gcInterval)
+	g.ticker = time.NewTicker(g.cfg.Interval)
 
 	for {
 		select {
@@ -66,18 +71,54 @@ func (g *garbageCollector) Interrupt(_ error) {
 
 func (g *garbageCollector) collect() error {
 	ctx := context.Background()
+	now := time.Now()
+
+	// stores that expire sessions themselves have nothing to prune
+	if g.sessions != nil {
+		n, err := g.sessions.Prune(ctx, now.Add(-g.cfg.SessionMaxAge).UTC())
+		if err != nil {
+			// sessions are best effort, don't stop chunk collection over it
+			g.l.WithError(err).Warn("pruning hls sessions")
+		}
+		if n > 0 {
+			g.l.Debugf("gc'd %d hls sessions", n)
+		}
+	}
 
-	n := g.hlsSess.pruneSessions(time.Now().Add(-sessMaxAge).UTC())
-	if n > 0 {
-		g.l.Debugf("gc'd %d hls sessions", n)
+	configured := make(map[string]configStream, len(g.streams))
+	for _, s := range g.streams {
+		configured[s.ID] = s
 	}
+	var bases []string
+	for _, id := range g.idx.Streams() {
+		// variants are collected with their stream
+		base, _, _ := strings.Cut(id, "/")
+		if !slices.Contains(bases, base) {
+			bases = append(bases, base)
+		}
+	}
+	for _, id := range bases {
+		ret := retentionConfig{MaxAge: unconfiguredMaxAge}
+		if s, ok := configured[id]; ok {
+			ret = s.Retention
+		}
+		if err := g.collectStream(ctx, id, now.Add(-ret.MaxAge).UTC(), ret.MaxBytes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-	ecs := g.idx.ExpiredChunks(time.Now().Add(-chunkMaxAge).UTC(), expiredChunksMax)
+// collectStream deletes the chunks of a stream and its variants that are past
+// its retention.
+func (g *garbageCollector) collectStream(ctx context.Context, streamID string, cutoff time.Time, maxBytes int64) error {
+	ecs := g.idx.ExpiredStreamChunks(streamID, cutoff, maxBytes, expiredChunksMax)
 	if len(ecs) < 1 {
 		return nil
 	}
 
-	g.l.Debugf("found %d expired chunks (max %d)", len(ecs), expiredChunksMax)
+	g.l.Debugf("found %d expired chunks for %s (max %d)", len(ecs), streamID, expiredChunksMax)
 
 	for _, rc := range ecs {
 		if err := g.obj.DeleteObject(ctx, rc.ObjectKey); err != nil {
@@ -86,6 +127,5 @@ func (g *garbageCollector) collect() error {
 		g.idx.Remove(rc)
 		g.l.Debugf("deleted chunk %s seq %d", rc.ObjectKey, rc.Sequence)
 	}
-
 	return nil
 }
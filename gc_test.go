@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
@@ -38,7 +39,8 @@ func TestGC(t *testing.T) {
 	}
 
 	del := &recordingDeleter{}
-	gc := newGarbageCollector(logrus.New(), idx, del, hlsSess)
+	streams := []configStream{{ID: "ts", Retention: retentionConfig{MaxAge: 24 * time.Hour}}}
+	gc := newGarbageCollector(logrus.New(), idx, del, hlsSess, streams, gcConfig{Interval: time.Hour, SessionMaxAge: 12 * time.Hour})
 
 	if err := gc.collect(); err != nil {
 		t.Fatal(err)
@@ -56,12 +58,107 @@ func TestGC(t *testing.T) {
 		t.Errorf("want 1 object delete, got %d %v", len(del.keys), del.keys)
 	}
 
-	sd1 := hlsSess.Get(ctx, sid1)
+	sd1, _ := hlsSess.Get(ctx, sid1)
 	if sd1.StreamID != "keep" {
 		t.Error("fresh session should survive GC")
 	}
-	sd2 := hlsSess.Get(ctx, sid2)
+	sd2, _ := hlsSess.Get(ctx, sid2)
 	if sd2.StreamID != "" {
 		t.Error("stale session should be pruned")
 	}
 }
+
+func TestGCRetention(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	idx := newChunkIndex()
+	for i := range 10 {
+		idx.Append("short", recordedChunk{
+			Sequence:  i + 1,
+			ChunkID:   fmt.Sprintf("short-%d", i+1),
+			FetchedAt: now.Add(time.Duration(i-9) * time.Hour),
+			ObjectKey: fmt.Sprintf("short/%d", i+1),
+			Size:      100,
+		})
+		idx.Append("quota", recordedChunk{
+			Sequence:  i + 1,
+			ChunkID:   fmt.Sprintf("quota-%d", i+1),
+			FetchedAt: now.Add(time.Duration(i-9) * time.Minute),
+			ObjectKey: fmt.Sprintf("quota/%d", i+1),
+			Size:      100,
+		})
+		// no longer configured, so kept for the default retention
+		idx.Append("dropped", recordedChunk{
+			Sequence:  i + 1,
+			ChunkID:   fmt.Sprintf("dropped-%d", i+1),
+			FetchedAt: now.Add(-unconfiguredMaxAge).Add(time.Duration(i-4) * time.Hour),
+			ObjectKey: fmt.Sprintf("dropped/%d", i+1),
+			Size:      100,
+		})
+	}
+
+	streams := []configStream{
+		{ID: "short", Retention: retentionConfig{MaxAge: 3*time.Hour + time.Minute}},
+		{ID: "quota", Retention: retentionConfig{MaxAge: 24 * time.Hour, MaxBytes: 250}},
+	}
+	gc := newGarbageCollector(logrus.New(), idx, &recordingDeleter{}, newHLSSessions(), streams, gcConfig{SessionMaxAge: time.Hour})
+	if err := gc.collect(); err != nil {
+		t.Fatal(err)
+	}
+
+	for sid, want := range map[string]int{"short": 4, "quota": 2, "dropped": 5} {
+		cs, err := idx.Chunks(ctx, sid, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cs) != want {
+			t.Errorf("%s: want %d chunks left, got %d", sid, want, len(cs))
+		}
+		if len(cs) > 0 && cs[len(cs)-1].Sequence != 10 {
+			t.Errorf("%s: newest chunk should be kept, got %#v", sid, cs[len(cs)-1])
+		}
+	}
+}
+
+func TestGCVariantRetention(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	idx := newChunkIndex()
+	for i := range 10 {
+		for name, size := range map[string]int64{"hi": 200, "lo": 50} {
+			id := "v/" + name
+			// variants start a little apart
+			at := now.Add(time.Duration(i-9) * 10 * time.Second)
+			if name == "lo" {
+				at = at.Add(200 * time.Millisecond)
+			}
+			idx.Append(id, recordedChunk{
+				Sequence:  i + 1,
+				ChunkID:   fmt.Sprintf("%s-%d", name, i+1),
+				Duration:  10,
+				FetchedAt: at,
+				ObjectKey: fmt.Sprintf("%s/%d", id, i+1),
+				Size:      size,
+			})
+		}
+	}
+
+	// the quota is for the stream as a whole, room for 4 of each
+	streams := []configStream{{ID: "v", Retention: retentionConfig{MaxAge: 24 * time.Hour, MaxBytes: 1000}}}
+	gc := newGarbageCollector(logrus.New(), idx, &recordingDeleter{}, newHLSSessions(), streams, gcConfig{SessionMaxAge: time.Hour})
+	if err := gc.collect(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"v/hi", "v/lo"} {
+		cs, err := idx.Chunks(ctx, id, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cs) != 4 || cs[0].Sequence != 7 {
+			t.Errorf("%s: want chunks 7 to 10 left, got %#v", id, cs)
+		}
+	}
+}
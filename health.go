@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/etherlabsio/go-m3u8/m3u8"
+)
+
+// fetcherState is how a stream's fetcher is getting on with its source.
+type fetcherState string
+
+const (
+	// fetcherHealthy is recording from the first source with no errors.
+	fetcherHealthy fetcherState = "healthy"
+	// fetcherDegraded is still recording, but polls or segments are failing
+	// or it's on a backup source.
+	fetcherDegraded fetcherState = "degraded"
+	// fetcherStalled gets the playlist, but its media sequence has stopped
+	// moving.
+	fetcherStalled fetcherState = "stalled"
+	// fetcherFailing can't get the playlist, and has been backing off.
+	fetcherFailing fetcherState = "failing"
+)
+
+var fetcherStates = []fetcherState{fetcherHealthy, fetcherDegraded, fetcherStalled, fetcherFailing}
+
+// fetchBackoffBase is the wait after the first failed poll, doubling for each
+// one after.
+const fetchBackoffBase = time.Second
+
+// fetchBackoff returns the wait before the next poll after n failed in a row.
+// It's jittered between half and all of the doubled wait, so fetchers of
+// streams on the same CDN don't retry in step.
+func fetchBackoff(n int, limit time.Duration) time.Duration {
+	d := limit
+	if n < 32 {
+		d = min(fetchBackoffBase<<max(n-1, 0), limit)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// fetcherStatus is the health of a stream's fetcher, as served at /status.
+type fetcherStatus struct {
+	StreamID string       `json:"streamId"`
+	State    fetcherState `json:"state"`
+	// Since is when it moved in to State.
+	Since time.Time `json:"since"`
+	// Source is the URL being fetched from.
+	Source string `json:"source"`
+	// Errors is how many polls in a row have failed, and LastError the most
+	// recent problem.
+	Errors    int       `json:"errors"`
+	LastError string    `json:"lastError,omitempty"`
+	LastPoll  time.Time `json:"lastPoll,omitzero"`
+	// LastProgress is when a new segment was last recorded.
+	LastProgress time.Time `json:"lastProgress,omitzero"`
+	NextPoll     time.Time `json:"nextPoll,omitzero"`
+}
+
+// stalled notes the media sequence of a playlist fetched for the recording at
+// now, and reports if it hasn't moved for n of the playlist's target
+// durations.
+func (r *recording) stalled(pl *m3u8.Playlist, now time.Time, n int) bool {
+	if r.seqAt.IsZero() || pl.Sequence != r.seq {
+		r.seq, r.seqAt = pl.Sequence, now
+		return false
+	}
+	// a finished playlist isn't going to move
+	if !pl.IsLive() {
+		return false
+	}
+	target := time.Duration(max(pl.Target, 1)) * time.Second
+	return now.Sub(r.seqAt) > time.Duration(n)*target
+}
+
+// healthState works out the fetcher's state after a poll.
+func (f *fetcher) healthState() fetcherState {
+	switch {
+	case f.pollErrors >= f.failover.Failures:
+		return fetcherFailing
+	case f.pollErrors == 0 && f.stalled:
+		return fetcherStalled
+	case f.pollErrors > 0 || f.segmentErrors > 0 || f.source != 0:
+		return fetcherDegraded
+	}
+	return fetcherHealthy
+}
+
+// updateStatus records the outcome of a poll at now, with the next in next.
+func (f *fetcher) updateStatus(now time.Time, pollErr error, next time.Duration) {
+	state := f.healthState()
+
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	if state != f.status.State {
+		if state == fetcherHealthy {
+			f.l.Infof("fetcher is %s again after being %s for %s", state, f.status.State, now.Sub(f.status.Since).Round(time.Second))
+		} else {
+			f.l.Warnf("fetcher is %s, was %s", state, f.status.State)
+		}
+		f.status.State, f.status.Since = state, now
+		setFetcherStateMetric(f.streamID, state)
+	}
+	f.status.Source = f.sources[f.source].String()
+	f.status.Errors = f.pollErrors
+	switch {
+	case pollErr != nil:
+		f.status.LastError = pollErr.Error()
+	case state == fetcherHealthy:
+		f.status.LastError = ""
+	}
+	f.status.LastPoll = now
+	f.status.LastProgress = f.progressAt
+	f.status.NextPoll = now.Add(next)
+}
+
+// Status returns the fetcher's current health.
+func (f *fetcher) Status() fetcherStatus {
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	return f.status
+}
+
+func setFetcherStateMetric(streamID string, state fetcherState) {
+	for _, s := range fetcherStates {
+		var v float64
+		if s == state {
+			v = 1
+		}
+		fetchStateGauge.WithLabelValues(streamID, string(s)).Set(v)
+	}
+}
+
+// statusServer serves the health of the stream fetchers.
+type statusServer struct {
+	fetchers []*fetcher
+}
+
+func newStatusServer(fetchers []*fetcher) *statusServer {
+	return &statusServer{fetchers: fetchers}
+}
+
+func (s *statusServer) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	resp := struct {
+		Streams []fetcherStatus `json:"streams"`
+	}{Streams: []fetcherStatus{}}
+	for _, f := range s.fetchers {
+		resp.Streams = append(resp.Streams, f.Status())
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etherlabsio/go-m3u8/m3u8"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFetchBackoff(t *testing.T) {
+	for n := 1; n <= 10; n++ {
+		want := min(fetchBackoffBase<<(n-1), time.Minute)
+		for range 20 {
+			if d := fetchBackoff(n, time.Minute); d < want/2 || d > want {
+				t.Fatalf("after %d failures want between %s and %s, got %s", n, want/2, want, d)
+			}
+		}
+	}
+	if d := fetchBackoff(100, time.Minute); d < 30*time.Second || d > time.Minute {
+		t.Errorf("want a long run of failures capped, got %s", d)
+	}
+}
+
+func TestRecordingStalled(t *testing.T) {
+	read := func(s string) *m3u8.Playlist {
+		t.Helper()
+		pl, err := m3u8.Read(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pl
+	}
+	pl5 := read("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:5\n#EXTINF:10,\na.aac\n")
+	pl6 := read("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:6\n#EXTINF:10,\nb.aac\n")
+	ended := read("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:6\n#EXTINF:10,\nb.aac\n#EXT-X-ENDLIST\n")
+
+	t0 := time.Now()
+	rec := newRecording(nil)
+	for _, tc := range []struct {
+		Name string
+		PL   *m3u8.Playlist
+		At   time.Duration
+		Want bool
+	}{
+		{Name: "First fetch", PL: pl5},
+		{Name: "Within 3 target durations", PL: pl5, At: 30 * time.Second},
+		{Name: "Past 3 target durations", PL: pl5, At: 31 * time.Second, Want: true},
+		{Name: "Moved on", PL: pl6, At: 40 * time.Second},
+		{Name: "Ended", PL: ended, At: 2 * time.Minute},
+	} {
+		if got := rec.stalled(tc.PL, t0.Add(tc.At), 3); got != tc.Want {
+			t.Errorf("%s: want stalled %t, got %t", tc.Name, tc.Want, got)
+		}
+	}
+}
+
+func TestFetcherHealthState(t *testing.T) {
+	for _, tc := range []struct {
+		Name  string
+		Setup func(f *fetcher)
+		Want  fetcherState
+	}{
+		{Name: "Healthy", Setup: func(f *fetcher) {}, Want: fetcherHealthy},
+		{Name: "Poll failed", Setup: func(f *fetcher) { f.pollErrors = 1 }, Want: fetcherDegraded},
+		{Name: "Segment failed", Setup: func(f *fetcher) { f.segmentErrors = 1 }, Want: fetcherDegraded},
+		{Name: "On a backup", Setup: func(f *fetcher) { f.source = 1 }, Want: fetcherDegraded},
+		{Name: "Stalled", Setup: func(f *fetcher) { f.stalled = true }, Want: fetcherStalled},
+		{Name: "Failing", Setup: func(f *fetcher) { f.pollErrors, f.stalled = 3, true }, Want: fetcherFailing},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			f := &fetcher{failover: failoverConfig{Failures: 3}}
+			tc.Setup(f)
+			if got := f.healthState(); got != tc.Want {
+				t.Errorf("want %s, got %s", tc.Want, got)
+			}
+		})
+	}
+}
+
+func TestServeStatus(t *testing.T) {
+	s := configStream{ID: "s", URL: "http://example.com/s.m3u8", Failover: failoverConfig{Failures: 2}}
+	f, err := newFetcher(logrus.New(), nil, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := newStatusServer([]*fetcher{f})
+	get := func() fetcherStatus {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		ss.ServeStatus(rec, httptest.NewRequest("GET", "/status", nil))
+		var resp struct {
+			Streams []fetcherStatus `json:"streams"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Streams) != 1 {
+			t.Fatalf("want one stream, got %v", resp.Streams)
+		}
+		return resp.Streams[0]
+	}
+
+	now := time.Now()
+	f.pollErrors = 2
+	f.updateStatus(now, errors.New("wanted 200, got: 502"), 4*time.Second)
+	st := get()
+	if st.StreamID != "s" || st.State != fetcherFailing || st.Errors != 2 || st.LastError != "wanted 200, got: 502" {
+		t.Errorf("want failing with the error, got %+v", st)
+	}
+	if !st.NextPoll.Equal(now.Add(4 * time.Second)) {
+		t.Errorf("want the next poll after the backoff, got %s", st.NextPoll)
+	}
+
+	f.pollErrors = 0
+	f.updateStatus(now.Add(time.Minute), nil, 5*time.Second)
+	st = get()
+	if st.State != fetcherHealthy || st.LastError != "" || !st.Since.Equal(now.Add(time.Minute)) {
+		t.Errorf("want healthy again since the last poll, got %+v", st)
+	}
+}
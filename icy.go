@@ -6,11 +6,9 @@ import (
 	"io"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"time"
 
-	"github.com/Comcast/gots/v2/packet"
-	"github.com/Comcast/gots/v2/pes"
-	"github.com/Comcast/gots/v2/psi"
 	"github.com/sirupsen/logrus"
 )
 
@@ -19,6 +17,18 @@ import (
 // the user to be ahead
 const streamBuffer = 30 * time.Second
 
+const (
+	defaultICYStallTimeout = 2 * time.Minute
+	// icyFillAhead is how far ahead of the listener fill audio is kept while
+	// waiting for chunks. It's kept short, as everything sent pushes the real
+	// audio back for them.
+	icyFillAhead = 3 * time.Second
+)
+
+// icyStallPoll is how often the index is checked for new chunks while a
+// listener is waiting.
+var icyStallPoll = time.Second
+
 // icyServer serves a given station over icecast
 type icyServer struct {
 	l logrus.FieldLogger
@@ -26,15 +36,21 @@ type icyServer struct {
 	streams []configStream
 
 	indexer *chunkIndex
-	store   *s3ChunkStore
+	store   chunkStore
+	bcast   *icyBroadcaster
+	cfg     icyConfig
+	fill    *icyFiller
 }
 
-func newIcyServer(l logrus.FieldLogger, s []configStream, i *chunkIndex, st *s3ChunkStore) *icyServer {
+func newIcyServer(l logrus.FieldLogger, s []configStream, i *chunkIndex, st chunkStore, cfg icyConfig, fill *icyFiller) *icyServer {
 	return &icyServer{
 		l:       l,
 		indexer: i,
 		streams: s,
 		store:   st,
+		bcast:   newICYBroadcaster(st),
+		cfg:     cfg,
+		fill:    fill,
 	}
 }
 
@@ -51,34 +67,32 @@ func (i *icyServer) ServeIcecast(w http.ResponseWriter, r *http.Request) {
 	now := time.Now()
 
 	streamID := r.URL.Query().Get("stream")
-	tzStr := r.URL.Query().Get("tz")
+	sr := shiftRequestFromQuery(r.URL.Query())
 
-	if streamID == "" || tzStr == "" {
-		http.Error(w, "stream and tz must be present on query", http.StatusBadRequest)
+	if streamID == "" || sr.empty() {
+		http.Error(w, "stream and one of tz, delay or at must be present on query", http.StatusBadRequest)
 		return
 	}
 
-	l = l.WithField("stream", streamID).WithField("tz", tzStr)
+	l = l.WithField("stream", streamID).WithField("tz", sr.Timezone)
 
-	var baseTZ string
-	var stationName string
-	for _, s := range i.streams {
-		if s.ID == streamID {
-			baseTZ = s.BaseTimezone
-			stationName = s.Name
-		}
-	}
-	if baseTZ == "" {
+	st, ok := findStream(i.streams, streamID)
+	if !ok {
 		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
 		return
 	}
 
-	offset, err := offsetForTimezone(baseTZ, tzStr)
+	ts, err := sr.timeshift(st, now)
 	if err != nil {
 		l.WithError(err).Debugf("finding offset")
 		http.Error(w, fmt.Sprintf("Error calculating offset: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
+	offset := ts.Offset(now)
+	if err := st.checkOffset(offset); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	l.Debugf("offset %s", offset.String())
 
@@ -90,11 +104,44 @@ func (i *icyServer) ServeIcecast(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = st.Language
+	}
+	sub := i.bcast.Subscribe(streamID, lang, offset)
+	defer func() { sub.Close() }()
+
+	// the content type depends on the source's codec, so load the first chunk
+	// before sending headers. The loop below gets it again from the group.
+	rcs, err := i.indexer.Chunks(ctx, streamID, s, 1)
+	if err != nil || len(rcs) < 1 {
+		serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
+		l.WithError(err).Errorf("getting first chunk from %d", s)
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+	first, err := sub.Audio(ctx, rcs[0])
+	if err != nil {
+		serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
+		l.WithError(err).Error("loading first chunk")
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+
 	// now we want to get a sequence, stream it's contents, and sleep.
 
 	w.Header().Set("X-Accel-Buffering", "no")
-	w.Header().Set("Content-Type", "audio/aacp")
-	w.Header().Set("icy-name", stationName)
+	w.Header().Set("Content-Type", first.contentType)
+	w.Header().Set("icy-name", st.Name)
+
+	var out io.Writer = w
+	var meta *icyMetaWriter
+	if r.Header.Get("Icy-MetaData") == "1" && i.cfg.MetaInt > 0 {
+		w.Header().Set("icy-metaint", strconv.Itoa(i.cfg.MetaInt))
+		meta = newICYMetaWriter(w, i.cfg.MetaInt)
+		out = meta
+	}
+	base := loadLocationOrUTC(st.BaseTimezone)
 
 	// note - from this point on http.Error is useless, we've already served headers and stuff
 
@@ -103,6 +150,15 @@ func (i *icyServer) ServeIcecast(w http.ResponseWriter, r *http.Request) {
 	streamStart := time.Now()
 	servedTime := time.Duration(0)
 
+	var joiner audioJoiner
+	// a frame header from the stream, to match fill to
+	lastHeader := first.adtsHeader()
+	var (
+		stallStart time.Time
+		fill       *icyFill
+		// the last chunk sent, if the next one should follow on from it
+		prev recordedChunk
+	)
 	nextRun := time.NewTimer(0)
 
 	for {
@@ -118,17 +174,57 @@ func (i *icyServer) ServeIcecast(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			if len(rcs) < 1 {
-				l.Warnf("got no chunks")
-				return
+				// at the live edge, or the fetcher is behind. Hang on for
+				// more, keeping the listener's decoder fed if we can.
+				if stallStart.IsZero() {
+					l.Debugf("waiting for chunk %d", s)
+					stallStart = nowFn()
+					fill = i.fill.forStream(lastHeader)
+				}
+				if stalled := nowFn().Sub(stallStart); stalled > i.cfg.StallTimeout {
+					l.Warnf("no new chunks for %s, disconnecting", stalled)
+					return
+				}
+				if fill != nil {
+					if ahead := servedTime - nowFn().Sub(streamStart); ahead < icyFillAhead {
+						audio, d := fill.Read(icyFillAhead - ahead)
+						if _, err := out.Write(audio); err != nil {
+							l.WithError(err).Debug("writing fill")
+							return
+						}
+						servedTime += d
+					}
+				}
+				nextRun.Reset(icyStallPoll)
+				continue
+			}
+			if !stallStart.IsZero() {
+				l.Debugf("resuming after waiting %s", nowFn().Sub(stallStart))
+				stallStart = time.Time{}
 			}
 			c := rcs[0]
 
 			l = l.WithField("seq", c.Sequence).WithField("cid", c.ChunkID)
 
-			rawAAC, err := i.streamChunkBody(ctx, w, l, streamID, c)
+			if meta != nil {
+				meta.SetTitle(icyStreamTitle(st, base, c))
+			}
+			if silence, d := gapSilence(i.cfg.GapPolicy, prev, c, lastHeader); d > 0 {
+				l.Debugf("filling %s gap before chunk with silence", d)
+				if _, err := out.Write(silence); err != nil {
+					l.WithError(err).Debug("writing gap silence")
+					return
+				}
+				servedTime += d
+			}
+			audio, err := i.streamChunkBody(ctx, out, l, sub, &joiner, streamID, c)
 			if err != nil {
 				return
 			}
+			if h := audio.adtsHeader(); h != nil {
+				lastHeader = h
+			}
+			prev = c
 
 			// We want to make sure the user has been served enough data for the
 			// time elapsed since the start of the stream, plus streamBuffer.
@@ -143,7 +239,22 @@ func (i *icyServer) ServeIcecast(w http.ResponseWriter, r *http.Request) {
 			servedTime = servedTime + cd
 			s = c.Sequence + 1
 
-			l.Debugf("s: %d rawAAC: %t gotSeq %d streamStart %s servedTime %s calcSleep %s", s, rawAAC, c.Sequence, streamStart.String(), servedTime.String(), calculateIcySleep(streamStart, servedTime).String())
+			l.Debugf("s: %d gotSeq %d streamStart %s servedTime %s calcSleep %s", s, c.Sequence, streamStart.String(), servedTime.String(), calculateIcySleep(streamStart, servedTime).String())
+
+			if no, changed := ts.Next(offset, nowFn()); changed && st.checkOffset(no) == nil {
+				ns, err := i.indexer.SequenceFor(ctx, streamID, nowFn().Add(-no))
+				if err != nil {
+					serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
+					l.WithError(err).Errorf("getting sequence for %s", streamID)
+					return
+				}
+				l.Debugf("offset changed from %s to %s, moving from seq %d to %d", offset, no, s, ns)
+				offset = no
+				s = ns
+				prev = recordedChunk{}
+				sub.Close()
+				sub = i.bcast.Subscribe(streamID, lang, offset)
+			}
 
 			// set the timer to the calculated sleep interval
 			nextRun.Reset(calculateIcySleep(streamStart, servedTime))
@@ -151,84 +262,52 @@ func (i *icyServer) ServeIcecast(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (i *icyServer) streamChunkBody(ctx context.Context, w http.ResponseWriter, l logrus.FieldLogger, streamID string, c recordedChunk) (rawAAC bool, err error) {
-	cr, err := i.store.GetObjectReader(ctx, c)
+// streamChunkBody writes a chunk's audio to the listener, shared with the rest
+// of their broadcast group.
+func (i *icyServer) streamChunkBody(ctx context.Context, w io.Writer, l logrus.FieldLogger, sub *icySubscription, j *audioJoiner, streamID string, c recordedChunk) (chunkAudio, error) {
+	audio, err := sub.Audio(ctx, c)
 	if err != nil {
 		serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
-		l.WithError(err).Error("getting chunk reader")
-		return false, err
+		l.WithError(err).Error("loading chunk")
+		return chunkAudio{}, err
+	}
+	if err := j.Write(w, c, audio); err != nil {
+		serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
+		l.WithError(err).Error("streaming chunk")
+		return chunkAudio{}, err
+	}
+	return audio, nil
+}
+
+// readChunkAudio loads the audio in a chunk. .aac chunks are already ADTS and
+// are just framed, anything else is assumed to be MPEG-TS and has the audio
+// elementary stream for lang (or the first, see selectAudioStream) demuxed.
+func readChunkAudio(ctx context.Context, store chunkStore, c recordedChunk, lang string) (chunkAudio, error) {
+	cr, err := store.GetObjectReader(ctx, c)
+	if err != nil {
+		return chunkAudio{}, fmt.Errorf("getting chunk reader: %w", err)
 	}
 	defer cr.Close()
 
-	/* more gross shit in some gross code
-	 * clean this up a bit to be better about content type management, and
-	 * structure in to not-big-if-else
-	 */
 	if filepath.Ext(c.ChunkID) == ".aac" {
-		rawAAC = true
-		if _, err := io.Copy(w, cr); err != nil {
-			serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
-			l.WithError(err).Error("writing aac chunk to consumer")
-			return true, err
+		var f adtsFramer
+		b, err := io.ReadAll(cr)
+		if err != nil {
+			return chunkAudio{}, fmt.Errorf("reading aac chunk: %w", err)
 		}
-		return true, nil
+		f.Write(b)
+		ca := chunkAudio{contentType: contentTypeAAC}
+		ca.frames, ca.head, ca.tail = f.Close()
+		return ca, nil
 	}
 
 	/* assume it's a ts stream, like it used to be */
 
-	pat, err := psi.ReadPAT(cr)
+	ca, err := demuxTSAudio(cr, lang)
 	if err != nil {
-		serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
-		l.WithError(err).Error("getting pat")
-		return false, err
-	}
-	_ = pat
-
-	const audioPid = 256
-
-	var pkt packet.Packet
-	for read, err := cr.Read(pkt[:]); read > 0 && err == nil; read, err = cr.Read(pkt[:]) {
-		if packet.Pid(&pkt) != audioPid {
-			continue
-		}
-		if !pkt.HasPayload() {
-			continue
-		}
-
-		if packet.PayloadUnitStartIndicator(&pkt) {
-			ph, err := packet.PESHeader(&pkt)
-			if err != nil {
-				serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
-				l.WithError(err).Errorf("getting packet header")
-				return false, err
-			}
-			pes, err := pes.NewPESHeader(ph)
-			if err != nil {
-				serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
-				l.WithError(err).Errorf("creating pes header")
-				return false, err
-			}
-			if _, err := w.Write(pes.Data()); err != nil {
-				serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
-				l.WithError(err).Error("writing packet")
-				return false, err
-			}
-		} else {
-			pl, err := pkt.Payload()
-			if err != nil {
-				serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
-				l.WithError(err).Error("getting packet payload")
-				return false, err
-			}
-
-			if _, err := w.Write(pl); err != nil {
-				serveEndpointErrorCount.WithLabelValues("icy", streamID).Inc()
-				l.WithError(err).Error("writing packet")
-				return false, err
-			}
-		}
+		return chunkAudio{}, fmt.Errorf("demuxing %s: %w", c.ChunkID, err)
 	}
-	return false, nil
+	return ca, nil
 }
 
 var nowFn = time.Now
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 func TestCalcSleep(t *testing.T) {
@@ -55,3 +61,69 @@ func TestCalcSleep(t *testing.T) {
 		})
 	}
 }
+
+func TestServeIcecastWaitsForChunks(t *testing.T) {
+	icyStallPoll = 10 * time.Millisecond
+	defer func() { icyStallPoll = time.Second }()
+
+	ctx := context.Background()
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := func(seq int, b byte, at time.Time) recordedChunk {
+		key := encodeObjectKey("s", at, 0.1, seq, 0, fmt.Sprintf("chunk-%d.aac", seq))
+		if err := fs.PutObject(ctx, key, testADTSFrame(b, 20)); err != nil {
+			t.Fatal(err)
+		}
+		return recordedChunk{Sequence: seq, ChunkID: fmt.Sprintf("chunk-%d.aac", seq), Duration: 0.1, FetchedAt: at, ObjectKey: key}
+	}
+	idx.Append("s", chunk(1, 1, time.Now().Add(-time.Second)))
+
+	cfg := icyConfig{StallTimeout: 300 * time.Millisecond, Fill: icyFillSilence}
+	fill, err := newICYFiller(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := []configStream{{ID: "s", Name: "S", BaseTimezone: "UTC", Retention: retentionConfig{MaxAge: time.Hour}}}
+	srv := newIcyServer(logrus.New(), streams, idx, fs, cfg, fill)
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(done)
+		srv.ServeIcecast(rec, httptest.NewRequest("GET", "/icecast?stream=s&delay=0s", nil))
+	}()
+
+	// a new chunk turns up while the listener is waiting
+	time.Sleep(100 * time.Millisecond)
+	idx.Append("s", chunk(2, 2, time.Now()))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener wasn't disconnected after the stall timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("listener disconnected after %s, before the stall timeout", elapsed)
+	}
+
+	silence, _ := silentADTSFrame(testADTSFrame(1, 20))
+	body := rec.Body.Bytes()
+	if !bytes.HasPrefix(body, testADTSFrame(1, 20)) {
+		t.Fatal("want the first chunk first")
+	}
+	body = body[len(testADTSFrame(1, 20)):]
+	if !bytes.HasPrefix(body, silence) {
+		t.Error("want silence after the first chunk")
+	}
+	i := bytes.Index(body, testADTSFrame(2, 20))
+	if i < 0 {
+		t.Fatal("want the new chunk after waiting")
+	}
+	if len(bytes.ReplaceAll(body[:i], silence, nil)) != 0 {
+		t.Error("want only silence between the chunks")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	icyFillNone    = "none"
+	icyFillSilence = "silence"
+	icyFillSlate   = "slate"
+)
+
+const (
+	icyGapSkip    = "skip"
+	icyGapSilence = "silence"
+	// icyMaxGapSilence caps the silence played for a gap, past that the
+	// listener is better off hearing the stream again.
+	icyMaxGapSilence = time.Minute
+)
+
+// Raw data blocks for a silent AAC-LC frame, an all-zero single channel
+// element for mono and channel pair element for stereo.
+var (
+	aacSilenceMono   = []byte{0x01, 0x40, 0x20, 0x07}
+	aacSilenceStereo = []byte{0x21, 0x00, 0x49, 0x90, 0x02, 0x19, 0x00, 0x23, 0x80}
+)
+
+// adtsSampleRates is indexed by the header's sampling frequency index.
+var adtsSampleRates = [...]int64{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// adtsFrameDuration is how long the frame starting at b plays for. AAC frames
+// are always 1024 samples.
+func adtsFrameDuration(b []byte) time.Duration {
+	return time.Duration(1024 * int64(time.Second) / adtsSampleRates[adtsSampleRateIndex(b)])
+}
+
+func adtsSampleRateIndex(b []byte) byte {
+	return b[2] >> 2 & 0x0f
+}
+
+func adtsChannels(b []byte) byte {
+	return b[2]&0x01<<2 | b[3]>>6
+}
+
+// silentADTSFrame returns a silent frame in the same format as the frame
+// header hdr. ok is false if we have no silence for that format, only AAC-LC
+// mono and stereo are covered.
+func silentADTSFrame(hdr []byte) (frame []byte, ok bool) {
+	if _, ok := adtsFrameLength(hdr); !ok {
+		return nil, false
+	}
+	if hdr[2]>>6 != 1 {
+		return nil, false
+	}
+	var raw []byte
+	switch adtsChannels(hdr) {
+	case 1:
+		raw = aacSilenceMono
+	case 2:
+		raw = aacSilenceStereo
+	default:
+		return nil, false
+	}
+	n := adtsHeaderLen + len(raw)
+	f := []byte{0xff, 0xf1, hdr[2], hdr[3]&0xc0 | byte(n>>11), byte(n >> 3), byte(n&7)<<5 | 0x1f, 0xfc}
+	return append(f, raw...), true
+}
+
+// adtsHeader returns the header of the first frame in a, or nil if it has no
+// AAC frames.
+func (a chunkAudio) adtsHeader() []byte {
+	if a.contentType != contentTypeAAC || len(a.frames) < adtsHeaderLen {
+		return nil
+	}
+	return a.frames[:adtsHeaderLen]
+}
+
+// icyFiller makes the audio sent to ICY listeners while they wait for new
+// chunks, so their decoders don't give up on the stream.
+type icyFiller struct {
+	mode  string
+	slate [][]byte
+}
+
+// newICYFiller sets up fill for cfg, loading the slate if there is one. The
+// slate file must be ADTS AAC.
+func newICYFiller(cfg icyConfig) (*icyFiller, error) {
+	f := &icyFiller{mode: cfg.Fill}
+	if cfg.Fill != icyFillSlate {
+		return f, nil
+	}
+	b, err := os.ReadFile(cfg.SlatePath)
+	if err != nil {
+		return nil, fmt.Errorf("reading slate: %w", err)
+	}
+	var fr adtsFramer
+	fr.Write(b)
+	frames, _, _ := fr.Close()
+	for len(frames) > 0 {
+		n, _ := adtsFrameLength(frames)
+		f.slate = append(f.slate, frames[:n])
+		frames = frames[n:]
+	}
+	if len(f.slate) == 0 {
+		return nil, errors.New("no ADTS frames in slate")
+	}
+	return f, nil
+}
+
+// forStream returns fill for a stream whose frames look like hdr. The slate
+// is only used if it's in the same format as the stream, otherwise it falls
+// back to silence. It returns nil if there's nothing suitable to send.
+func (f *icyFiller) forStream(hdr []byte) *icyFill {
+	if f == nil || f.mode == icyFillNone || f.mode == "" {
+		return nil
+	}
+	if f.mode == icyFillSlate && len(hdr) >= adtsHeaderLen {
+		s := f.slate[0]
+		if adtsSampleRateIndex(s) == adtsSampleRateIndex(hdr) && adtsChannels(s) == adtsChannels(hdr) {
+			return &icyFill{frames: f.slate}
+		}
+	}
+	silence, ok := silentADTSFrame(hdr)
+	if !ok {
+		return nil
+	}
+	return &icyFill{frames: [][]byte{silence}}
+}
+
+// icyFill is one listener's fill, looping over frames.
+type icyFill struct {
+	frames [][]byte
+	next   int
+}
+
+// Read returns whole frames playing for at least d, and how long they do.
+func (f *icyFill) Read(d time.Duration) (audio []byte, dur time.Duration) {
+	for dur < d {
+		fr := f.frames[f.next]
+		f.next = (f.next + 1) % len(f.frames)
+		audio = append(audio, fr...)
+		dur += adtsFrameDuration(fr)
+	}
+	return audio, dur
+}
+
+// gapSilence returns silence for the time missing between prev and c, if c
+// follows a gap and the gap policy is to fill it. hdr is a frame header from
+// the stream.
+func gapSilence(policy string, prev, c recordedChunk, hdr []byte) (audio []byte, dur time.Duration) {
+	if policy != icyGapSilence || !c.Discontinuity || c.Sequence != prev.Sequence+1 {
+		return nil, 0
+	}
+	gap := min(gapBetween(prev, c), icyMaxGapSilence)
+	silence, ok := silentADTSFrame(hdr)
+	if gap <= 0 || !ok {
+		return nil, 0
+	}
+	return (&icyFill{frames: [][]byte{silence}}).Read(gap)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSilentADTSFrame(t *testing.T) {
+	stereo := testADTSFrame(1, 20) // AAC-LC 44.1kHz stereo
+	f, ok := silentADTSFrame(stereo)
+	if !ok {
+		t.Fatal("want silence for stereo")
+	}
+	if n, ok := adtsFrameLength(f); !ok || n != len(f) {
+		t.Errorf("silent frame should be one valid frame, got %x", f)
+	}
+	if !bytes.Equal(f[adtsHeaderLen:], aacSilenceStereo) {
+		t.Errorf("want stereo silence, got %x", f[adtsHeaderLen:])
+	}
+	if adtsSampleRateIndex(f) != adtsSampleRateIndex(stereo) || adtsChannels(f) != 2 {
+		t.Error("silent frame should match the stream's format")
+	}
+
+	mono := slices.Clone(stereo)
+	mono[3] = mono[3]&0x3f | 1<<6
+	if f, ok := silentADTSFrame(mono); !ok || !bytes.Equal(f[adtsHeaderLen:], aacSilenceMono) {
+		t.Errorf("want mono silence, got %x", f)
+	}
+
+	he := slices.Clone(stereo)
+	he[2] = he[2]&0x3f | 3<<6 // AAC LTP
+	if _, ok := silentADTSFrame(he); ok {
+		t.Error("want no silence for profiles other than LC")
+	}
+}
+
+func TestICYFill(t *testing.T) {
+	stream := testADTSFrame(0, 20)
+
+	if f := (&icyFiller{mode: icyFillNone}).forStream(stream); f != nil {
+		t.Error("want no fill for none")
+	}
+
+	silence, _ := silentADTSFrame(stream)
+	f := (&icyFiller{mode: icyFillSilence}).forStream(stream)
+	audio, d := f.Read(time.Second)
+	if frame := adtsFrameDuration(stream); d < time.Second || d >= time.Second+frame {
+		t.Errorf("want just over 1s of fill, got %s", d)
+	}
+	if len(bytes.ReplaceAll(audio, silence, nil)) != 0 {
+		t.Error("want only silence")
+	}
+
+	slatePath := filepath.Join(t.TempDir(), "slate.aac")
+	slate := slices.Concat(testADTSFrames(1, 3, 20)...)
+	if err := os.WriteFile(slatePath, slate, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	filler, err := newICYFiller(icyConfig{Fill: icyFillSlate, SlatePath: slatePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = filler.forStream(stream)
+	audio, _ = f.Read(4 * adtsFrameDuration(stream))
+	if want := append(slices.Clone(slate), testADTSFrame(1, 20)...); !bytes.Equal(audio, want) {
+		t.Errorf("want the slate looped, got %x", audio)
+	}
+
+	// a 48kHz stream can't have the 44.1kHz slate, so gets silence
+	other := slices.Clone(stream)
+	other[2] = other[2]&^0x3c | 3<<2
+	audio, _ = filler.forStream(other).Read(time.Millisecond)
+	if want, _ := silentADTSFrame(other); !bytes.Equal(audio, want) {
+		t.Errorf("want silence for a different format, got %x", audio)
+	}
+
+	if err := os.WriteFile(slatePath, []byte("not audio"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newICYFiller(icyConfig{Fill: icyFillSlate, SlatePath: slatePath}); err == nil {
+		t.Error("want error for a slate with no frames")
+	}
+}
+
+func TestGapSilence(t *testing.T) {
+	stream := testADTSFrame(0, 20)
+	silence, _ := silentADTSFrame(stream)
+	t0 := time.Date(2026, 4, 7, 0, 0, 0, 0, time.UTC)
+	prev := recordedChunk{Sequence: 1, Duration: 10, FetchedAt: t0}
+	c := recordedChunk{Sequence: 2, Duration: 10, FetchedAt: t0.Add(15 * time.Second), Discontinuity: true}
+
+	if audio, _ := gapSilence(icyGapSkip, prev, c, stream); audio != nil {
+		t.Error("want no silence when skipping gaps")
+	}
+	audio, d := gapSilence(icyGapSilence, prev, c, stream)
+	if d < 5*time.Second || d >= 5*time.Second+adtsFrameDuration(stream) {
+		t.Errorf("want about 5s of silence, got %s", d)
+	}
+	if len(audio) == 0 || len(bytes.ReplaceAll(audio, silence, nil)) != 0 {
+		t.Error("want only silence")
+	}
+
+	c.FetchedAt = t0.Add(time.Hour)
+	if _, d := gapSilence(icyGapSilence, prev, c, stream); d >= icyMaxGapSilence+adtsFrameDuration(stream) {
+		t.Errorf("want long gaps capped, got %s", d)
+	}
+
+	c.Discontinuity = false
+	if audio, _ := gapSilence(icyGapSilence, prev, c, stream); audio != nil {
+		t.Error("want no silence without a discontinuity")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	defaultICYMetaInt = 16000
+	// icyMetaMax is the most metadata one block can carry, the length byte
+	// counts 16 byte units.
+	icyMetaMax = 255 * 16
+)
+
+// icyMetaWriter interleaves ICY metadata blocks into an audio stream, one
+// after every metaInt bytes of audio, for clients that sent Icy-MetaData: 1.
+// The title is only sent when it changes, other blocks are empty.
+type icyMetaWriter struct {
+	w       io.Writer
+	metaInt int
+	// untilMeta is how much audio to write before the next block.
+	untilMeta int
+	title     string
+	sent      string
+}
+
+func newICYMetaWriter(w io.Writer, metaInt int) *icyMetaWriter {
+	return &icyMetaWriter{w: w, metaInt: metaInt, untilMeta: metaInt}
+}
+
+// SetTitle sets the StreamTitle for the next metadata block.
+func (m *icyMetaWriter) SetTitle(title string) {
+	m.title = title
+}
+
+// Write writes audio, inserting metadata blocks where they fall due.
+func (m *icyMetaWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		c := min(len(p), m.untilMeta)
+		wn, err := m.w.Write(p[:c])
+		n += wn
+		if err != nil {
+			return n, err
+		}
+		p = p[c:]
+		m.untilMeta -= c
+		if m.untilMeta == 0 {
+			if err := m.writeMeta(); err != nil {
+				return n, err
+			}
+			m.untilMeta = m.metaInt
+		}
+	}
+	return n, nil
+}
+
+func (m *icyMetaWriter) writeMeta() error {
+	if m.title == m.sent {
+		_, err := m.w.Write([]byte{0})
+		return err
+	}
+	// there is no escaping, so a quote would end the title early
+	meta := "StreamTitle='" + strings.ReplaceAll(m.title, "'", "’") + "';"
+	if len(meta) > icyMetaMax {
+		meta = strings.ToValidUTF8(meta[:icyMetaMax-2], "") + "';"
+	}
+	blocks := (len(meta) + 15) / 16
+	buf := make([]byte, 1+blocks*16)
+	buf[0] = byte(blocks)
+	copy(buf[1:], meta)
+	if _, err := m.w.Write(buf); err != nil {
+		return err
+	}
+	m.sent = m.title
+	return nil
+}
+
+// icyStreamTitle is the station, the local time the chunk was broadcast at,
+// and what was playing if the source said.
+func icyStreamTitle(st configStream, base *time.Location, c recordedChunk) string {
+	t := fmt.Sprintf("%s - %s", st.Name, c.FetchedAt.In(base).Format("15:04"))
+	if c.Title != "" {
+		t += " - " + c.Title
+	}
+	return t
+}
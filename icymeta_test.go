@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestICYMetaWriter(t *testing.T) {
+	var buf bytes.Buffer
+	m := newICYMetaWriter(&buf, 4)
+
+	m.SetTitle("it's on")
+	if _, err := m.Write([]byte("abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	// unchanged title sends an empty block
+	if _, err := m.Write([]byte("gh")); err != nil {
+		t.Fatal(err)
+	}
+	m.SetTitle("next")
+	if _, err := m.Write([]byte("ijkl")); err != nil {
+		t.Fatal(err)
+	}
+
+	first := "StreamTitle='it’s on';"
+	second := "StreamTitle='next';"
+	want := "abcd" + block(first) + "efgh" + "\x00" + "ijkl" + block(second)
+	if got := buf.String(); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func block(meta string) string {
+	n := (len(meta) + 15) / 16
+	return string([]byte{byte(n)}) + meta + strings.Repeat("\x00", n*16-len(meta))
+}
+
+func TestICYStreamTitle(t *testing.T) {
+	perth, err := time.LoadLocation("Australia/Perth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := configStream{Name: "Double J"}
+	c := recordedChunk{FetchedAt: time.Date(2026, 1, 15, 0, 30, 0, 0, time.UTC), Title: "Artist - Song"}
+	if got, want := icyStreamTitle(st, perth, c), "Double J - 08:30 - Artist - Song"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	c.Title = ""
+	if got, want := icyStreamTitle(st, perth, c), "Double J - 08:30"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
@@ -7,10 +7,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"time"
 
 	_ "time/tzdata"
 
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -24,7 +26,7 @@ func main() {
 
 	var (
 		listen        = flag.String("listen", "localhost:8080", "Address to listen on")
-		metricsListen = flag.String("metrics-listen", "localhost:8090", "Address to serve metrics on (prom at /metrics), if set")
+		metricsListen = flag.String("metrics-listen", "localhost:8090", "Address to serve metrics on (prom at /metrics, fetcher health at /status), if set")
 		configPath    = flag.String("config", "", "path to config file")
 		debug         = flag.Bool("debug", false, "enable debug logging")
 	)
@@ -48,36 +50,122 @@ func main() {
 		l.Fatal(err)
 	}
 
-	s3Client, err := newS3Client(ctx, cfg.S3)
-	if err != nil {
-		l.WithError(err).Fatal("s3 client")
+	idx := newChunkIndex()
+
+	var (
+		store    chunkStore
+		s3Client *s3.Client
+	)
+	switch cfg.Storage.Type {
+	case storageFilesystem:
+		fs, err := newFSChunkStore(cfg.Storage.Filesystem.Root, idx)
+		if err != nil {
+			l.WithError(err).Fatal("filesystem store")
+		}
+		store = fs
+	default:
+		s3Client, err = newS3Client(ctx, cfg.S3)
+		if err != nil {
+			l.WithError(err).Fatal("s3 client")
+		}
+		if err := ensureS3Bucket(ctx, s3Client, cfg.S3.Bucket); err != nil {
+			l.WithError(err).Fatal("s3 bucket")
+		}
+		store = newS3ChunkStore(s3Client, cfg.S3.Bucket, cfg.S3.PresignTTL, idx)
 	}
-	if err := ensureS3Bucket(ctx, s3Client, cfg.S3.Bucket); err != nil {
-		l.WithError(err).Fatal("s3 bucket")
+
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "migrate-key-times":
+			if err := runMigrateKeyTimes(ctx, l, store, cfg.Streams, flag.Args()[1:]); err != nil {
+				l.WithError(err).Fatal("migrate-key-times")
+			}
+		default:
+			l.Fatalf("unknown command %q", flag.Arg(0))
+		}
+		return
 	}
 
-	idx := newChunkIndex()
-	store := newS3ChunkStore(s3Client, cfg.S3.Bucket, cfg.S3.PresignTTL, idx)
+	// serving and recording go through the cache and proxy, if configured.
+	chunks := store
+	if cfg.Cache.MaxBytes > 0 {
+		cs, err := newCachingChunkStore(store, cfg.Cache.MaxBytes, cfg.Cache.Disk.Dir, cfg.Cache.Disk.MaxBytes)
+		if err != nil {
+			l.WithError(err).Fatal("chunk cache")
+		}
+		chunks = cs
+	}
+	if cfg.Storage.Type == storageS3 && cfg.Storage.ChunkServing == chunkServingProxy {
+		chunks = newProxyChunkStore(chunks)
+	}
 
 	for _, s := range cfg.Streams {
 		if err := store.LoadStream(ctx, s.ID); err != nil {
 			l.WithError(err).Warnf("loading stream index for %s", s.ID)
 		}
+		// serve the variants we have straight away, the fetcher updates them
+		// from the source.
+		if s.RecordVariants {
+			idx.SetVariants(s.ID, storedVariants(s.ID, idx.SubStreams(s.ID)))
+		}
+	}
+
+	// streams dropped from the config are still indexed, so gc expires them
+	if ol, ok := store.(objectLister); ok {
+		ids, err := ol.ListStreams(ctx)
+		if err != nil {
+			l.WithError(err).Warn("listing stored streams")
+		}
+		for _, id := range ids {
+			if slices.ContainsFunc(cfg.Streams, func(s configStream) bool { return s.ID == id }) {
+				continue
+			}
+			l.Infof("stream %s is stored but not configured, its chunks will be removed after %s", id, unconfiguredMaxAge)
+			if err := store.LoadStream(ctx, id); err != nil {
+				l.WithError(err).Warnf("loading stream index for %s", id)
+			}
+		}
 	}
 
-	hlsSess := newHLSSessions()
-	pl := newPlaylist(l.WithField("component", "playlist"), cfg.Streams, idx, store, hlsSess)
-	is := newIcyServer(l.WithField("component", "icyServer"), cfg.Streams, idx, store)
+	var sessions sessionStore
+	switch cfg.Sessions.Store {
+	case sessionStoreToken:
+		ts, err := newTokenSessions(cfg.Sessions.Secret, cfg.GC.SessionMaxAge)
+		if err != nil {
+			l.WithError(err).Fatal("token sessions")
+		}
+		sessions = ts
+	case sessionStoreS3:
+		sessions = newS3Sessions(s3Client, cfg.S3.Bucket, cfg.GC.SessionMaxAge)
+	case sessionStoreRedis:
+		rc := newRedisClient(cfg.Sessions.Redis.Addr, cfg.Sessions.Redis.Password, cfg.Sessions.Redis.DB)
+		sessions = newRedisSessions(rc, cfg.GC.SessionMaxAge)
+	default:
+		sessions = newHLSSessions()
+	}
+	var sessPruner sessionPruner
+	if sp, ok := sessions.(sessionPruner); ok {
+		sessPruner = sp
+	}
+	pl := newPlaylist(l.WithField("component", "playlist"), cfg.Streams, idx, chunks, sessions)
+	fill, err := newICYFiller(cfg.ICY)
+	if err != nil {
+		l.WithError(err).Fatal("icy fill")
+	}
+	is := newIcyServer(l.WithField("component", "icyServer"), cfg.Streams, idx, chunks, cfg.ICY, fill)
+	ds := newDownloadServer(l.WithField("component", "download"), cfg.Streams, idx, chunks)
 
 	idxPage := newIndex(l.WithField("component", "index"), cfg.Streams)
 
-	gc := newGarbageCollector(l.WithField("component", "gc"), idx, store, hlsSess)
+	gc := newGarbageCollector(l.WithField("component", "gc"), idx, chunks, sessPruner, cfg.Streams, cfg.GC)
 
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/m3u8", pl.ServePlaylist)
 	mux.HandleFunc("/chunk", pl.ServeChunk)
+	mux.HandleFunc("/vod", pl.ServeVOD)
 	mux.HandleFunc("/icecast", is.ServeIcecast)
+	mux.HandleFunc("/download", ds.ServeDownload)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
 			http.Error(w, "Not Found", http.StatusNotFound)
@@ -97,15 +185,17 @@ func main() {
 
 	g.Add(gc.Run, gc.Interrupt)
 
+	var fetchers []*fetcher
 	for _, s := range cfg.Streams {
-		fcs := store.FetcherStore(s.ID)
+		fcs := newStationChunkStore(s.ID, chunks, idx)
 
-		f, err := newFetcher(l.WithField("component", "fetcher").WithField("stationid", s.ID), fcs, s.ID, s.URL)
+		f, err := newFetcher(l.WithField("component", "fetcher").WithField("stationid", s.ID), fcs, s)
 		if err != nil {
 			l.WithError(err).Fatal("creating fetcher")
 		}
 
 		g.Add(f.Run, f.Interrupt)
+		fetchers = append(fetchers, f)
 	}
 
 	if *metricsListen != "" {
@@ -117,6 +207,7 @@ func main() {
 
 		pm := http.NewServeMux()
 		pm.Handle("/metrics", ph)
+		pm.HandleFunc("/status", newStatusServer(fetchers).ServeStatus)
 
 		metricsSrv := &http.Server{
 			Addr:    *metricsListen,
@@ -17,6 +17,38 @@ var (
 		Name: "tjts_stream_fetch_errors",
 		Help: "Count of errors while fetching stream playlist or chunks",
 	}, []string{"streamid"})
+	fetchFailoverCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tjts_stream_fetch_failovers",
+		Help: "Count of times a stream's fetcher moved to another source",
+	}, []string{"streamid"})
+	fetchStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tjts_stream_fetch_state",
+		Help: "State of a stream's fetcher, 1 for the state it's in and 0 for the others",
+	}, []string{"streamid", "state"})
+	icyChunkLoadCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tjts_icy_chunk_loads",
+		Help: "Count of chunks fetched and demuxed for ICY broadcast groups",
+	}, []string{"streamid"})
+	icyChunkShareCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tjts_icy_chunk_shares",
+		Help: "Count of ICY chunk reads served from one already loaded for the broadcast group",
+	}, []string{"streamid"})
+	chunkCacheHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tjts_chunk_cache_hits",
+		Help: "Count of chunk reads served from the cache, by tier",
+	}, []string{"tier"})
+	chunkCacheMissCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tjts_chunk_cache_misses",
+		Help: "Count of chunk reads that went to storage",
+	})
+	chunkCacheEvictionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tjts_chunk_cache_evictions",
+		Help: "Count of chunks evicted from the cache, by tier",
+	}, []string{"tier"})
+	tsDemuxErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tjts_ts_demux_errors",
+		Help: "Count of problems found demuxing TS chunks, by kind",
+	}, []string{"kind"})
 )
 
 var _ prometheus.Collector = (*metricsCollector)(nil)
@@ -25,6 +57,7 @@ type metricsCollector struct {
 	idx *chunkIndex
 
 	latestChunkFetchAgo *prometheus.Desc
+	recordingGaps       *prometheus.Desc
 }
 
 func newMetricsCollector(idx *chunkIndex) *metricsCollector {
@@ -34,11 +67,16 @@ func newMetricsCollector(idx *chunkIndex) *metricsCollector {
 			"tjts_last_chunk_fetched_at",
 			"Time when last chunk was fetched, by stream",
 			[]string{"streamid"}, nil),
+		recordingGaps: prometheus.NewDesc(
+			"tjts_recording_gaps",
+			"Gaps and discontinuities in the retained recording, by stream",
+			[]string{"streamid"}, nil),
 	}
 }
 
 func (m *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- m.latestChunkFetchAgo
+	ch <- m.recordingGaps
 }
 
 func (m *metricsCollector) Collect(ch chan<- prometheus.Metric) {
@@ -48,6 +86,7 @@ func (m *metricsCollector) Collect(ch chan<- prometheus.Metric) {
 	lcts := m.lastChunkTimes(ctx)
 	for k, v := range lcts {
 		ch <- prometheus.MustNewConstMetric(m.latestChunkFetchAgo, prometheus.GaugeValue, float64(v.Unix()), k)
+		ch <- prometheus.MustNewConstMetric(m.recordingGaps, prometheus.GaugeValue, float64(len(m.idx.Gaps(k))), k)
 	}
 }
 
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultMigrateTolerance = time.Minute
+
+// Where migrate-key-times takes a chunk's time from when its key and
+// LastModified disagree.
+const (
+	// migrateFromKey keeps the key, which is what the index trusts.
+	// LastModified is rewritten by replication and copies.
+	migrateFromKey = "key"
+	// migrateFromLastModified rewrites the key to LastModified, for chunks
+	// recorded with a wrong clock on a bucket that was never copied.
+	migrateFromLastModified = "last-modified"
+)
+
+// runMigrateKeyTimes is the migrate-key-times command. The index is rebuilt
+// from the timestamp in each key, but older deployments used LastModified.
+// It reports keys that disagree with LastModified by more than the tolerance.
+// If the recorder's clock was wrong the keys are too, and with -from
+// last-modified and -apply they're rewritten to use LastModified instead.
+func runMigrateKeyTimes(ctx context.Context, l logrus.FieldLogger, store chunkStore, streams []configStream, args []string) error {
+	fs := flag.NewFlagSet("migrate-key-times", flag.ContinueOnError)
+	tolerance := fs.Duration("tolerance", defaultMigrateTolerance, "report keys whose timestamp differs from LastModified by more than this")
+	from := fs.String("from", migrateFromKey, "which time is right when they disagree: key keeps the key, last-modified rewrites it to LastModified")
+	apply := fs.Bool("apply", false, "rename objects, rather than only reporting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from != migrateFromKey && *from != migrateFromLastModified {
+		return fmt.Errorf("unknown -from %q, want %s or %s", *from, migrateFromKey, migrateFromLastModified)
+	}
+
+	ol, ok := store.(objectLister)
+	if !ok {
+		return fmt.Errorf("storage backend does not support listing objects")
+	}
+
+	for _, s := range streams {
+		n, err := migrateKeyTimes(ctx, l.WithField("stream", s.ID), ol, s.ID, *tolerance, *from, *apply)
+		if err != nil {
+			return fmt.Errorf("migrating %s: %w", s.ID, err)
+		}
+		switch {
+		case *from == migrateFromKey:
+			l.Infof("%s: %d keys disagree with LastModified, keeping the key times", s.ID, n)
+		case *apply:
+			l.Infof("%s: rewrote %d keys", s.ID, n)
+		default:
+			l.Infof("%s: %d keys would be rewritten, run with -apply to rename them", s.ID, n)
+		}
+	}
+	return nil
+}
+
+// migrateKeyTimes finds objects for a stream whose key timestamp and
+// LastModified differ by more than tolerance. Keys holding broadcast time are
+// left out, as they're meant to differ. If from is last-modified and
+// apply is set, they're renamed to a key with the LastModified time; from key
+// leaves them be. It returns how many objects disagreed.
+func migrateKeyTimes(ctx context.Context, l logrus.FieldLogger, ol objectLister, streamID string, tolerance time.Duration, from string, apply bool) (int, error) {
+	objs, err := ol.ListObjects(ctx, streamID)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, obj := range objs {
+		// the listing includes sub-streams, like variants, which keep their id
+		sid, kt, dur, seq, flags, chunkID, err := decodeObjectKey(obj.Key)
+		if err != nil {
+			continue
+		}
+		// the time in these keys came from the source, not our clock, so
+		// LastModified says nothing about whether it's right.
+		if flags&chunkFlagBroadcastTime != 0 {
+			continue
+		}
+		drift := obj.LastModified.Sub(kt)
+		if drift.Abs() <= tolerance {
+			continue
+		}
+		n++
+		if from != migrateFromLastModified {
+			l.Infof("%s: key time %s, last modified %s (drift %s), keeping the key", obj.Key, kt.Format(time.RFC3339), obj.LastModified.UTC().Format(time.RFC3339), drift)
+			continue
+		}
+		nk := encodeObjectKey(sid, obj.LastModified, dur, seq, flags, chunkID)
+		l.Infof("%s: key time %s, last modified %s (drift %s) -> %s", obj.Key, kt.Format(time.RFC3339), obj.LastModified.UTC().Format(time.RFC3339), drift, nk)
+		if !apply {
+			continue
+		}
+		if err := ol.RenameObject(ctx, obj.Key, nk); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMigrateKeyTimes(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	idx := newChunkIndex()
+	store, err := newFSChunkStore(root, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one.aac and two.aac were recorded before keys held broadcast time, so
+	// their key time is when they were uploaded.
+	now := time.Now().UTC()
+	for i, cid := range []string{"one.aac", "two.aac"} {
+		key := encodeObjectKey("m", now.Add(time.Duration(i)*10*time.Second), 10, i+1, 0, cid)
+		if err := store.PutObject(ctx, key, []byte(cid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.LoadStream(ctx, "m"); err != nil {
+		t.Fatal(err)
+	}
+	// three.aac starts in the broadcast well before it was uploaded
+	scs := newStationChunkStore("m", store, idx)
+	if err := scs.WriteChunk(ctx, "three.aac", now.Add(-time.Hour), 10, "", false, strings.NewReader("three.aac")); err != nil {
+		t.Fatal(err)
+	}
+	one, _ := idx.GetChunk("m", "one.aac")
+	two, _ := idx.GetChunk("m", "two.aac")
+	three, _ := idx.GetChunk("m", "three.aac")
+
+	// pretend one.aac was recorded with a clock an hour slow
+	actual := one.FetchedAt.Add(time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(root, one.ObjectKey), actual, actual); err != nil {
+		t.Fatal(err)
+	}
+
+	// the index is rebuilt from the key, regardless of modification time
+	idx2 := newChunkIndex()
+	store2, err := newFSChunkStore(root, idx2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store2.LoadStream(ctx, "m"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := idx2.GetChunk("m", "one.aac"); !got.FetchedAt.Equal(one.FetchedAt) {
+		t.Errorf("want FetchedAt %s from key, got %s", one.FetchedAt, got.FetchedAt)
+	}
+
+	l := logrus.New()
+	n, err := migrateKeyTimes(ctx, l, store2, "m", time.Minute, migrateFromLastModified, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("want 1 disagreeing key, got %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(root, one.ObjectKey)); err != nil {
+		t.Fatalf("dry run should not rename: %v", err)
+	}
+
+	// by default the key is trusted, even with -apply
+	if n, err := migrateKeyTimes(ctx, l, store2, "m", time.Minute, migrateFromKey, true); err != nil || n != 1 {
+		t.Fatalf("want 1 disagreeing key reported, got %d %v", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, one.ObjectKey)); err != nil {
+		t.Fatalf("keeping the key should not rename: %v", err)
+	}
+
+	if _, err := migrateKeyTimes(ctx, l, store2, "m", time.Minute, migrateFromLastModified, true); err != nil {
+		t.Fatal(err)
+	}
+
+	idx3 := newChunkIndex()
+	store3, err := newFSChunkStore(root, idx3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store3.LoadStream(ctx, "m"); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := idx3.GetChunk("m", "one.aac")
+	if !ok || !got.FetchedAt.Equal(actual) || got.Sequence != one.Sequence {
+		t.Errorf("want one.aac at %s seq %d after migration, got %#v", actual, one.Sequence, got)
+	}
+	if got, _ := idx3.GetChunk("m", "two.aac"); got.ObjectKey != two.ObjectKey {
+		t.Errorf("two.aac agreed with its key and should be untouched, got %s", got.ObjectKey)
+	}
+	if got, _ := idx3.GetChunk("m", "three.aac"); got.ObjectKey != three.ObjectKey {
+		t.Errorf("three.aac holds broadcast time and should be untouched, got %s", got.ObjectKey)
+	}
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/etherlabsio/go-m3u8/m3u8"
-	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/singleflight"
 )
@@ -21,26 +22,27 @@ const serveChunks = 3
 type playlist struct {
 	l logrus.FieldLogger
 
-	indexer *chunkIndex
-	store   *s3ChunkStore
-	streams []configStream
-	hlsSess *hlsSessions
+	indexer  *chunkIndex
+	store    chunkStore
+	streams  []configStream
+	sessions sessionStore
 
 	newEntrySF singleflight.Group
 }
 
-func newPlaylist(l logrus.FieldLogger, s []configStream, i *chunkIndex, st *s3ChunkStore, hs *hlsSessions) *playlist {
+func newPlaylist(l logrus.FieldLogger, s []configStream, i *chunkIndex, st chunkStore, ss sessionStore) *playlist {
 	return &playlist{
-		l:       l,
-		indexer: i,
-		streams: s,
-		store:   st,
-		hlsSess: hs,
+		l:        l,
+		indexer:  i,
+		streams:  s,
+		store:    st,
+		sessions: ss,
 	}
 }
 
-// ServePlaylist: entry ?stream=&tz= → 303 ?sid= (new UUID). Per-sid state lives only in RAM (like ICY’s
-// one connection advancing through the index, but split across playlist polls). Not written to object storage.
+// ServePlaylist: entry ?stream=&(tz=[&ahead=]|delay=|at=)[&dvr=] → 303 ?sid=. The listener's
+// position is worked out on entry, then per-sid state is kept in the sessionStore (like ICY’s
+// one connection advancing through the index, but split across playlist polls).
 func (p *playlist) ServePlaylist(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
@@ -53,22 +55,62 @@ func (p *playlist) ServePlaylist(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	sid := q.Get("sid")
 	streamQ := q.Get("stream")
-	tzQ := q.Get("tz")
+	srQ := shiftRequestFromQuery(q)
+	dvrQ := q.Get("dvr")
 
 	if sid == "" {
-		if streamQ == "" || tzQ == "" {
-			http.Error(w, "sid || stream and tz must be present on query", http.StatusBadRequest)
+		if streamQ == "" || srQ.empty() {
+			http.Error(w, "sid || stream and one of tz, delay or at must be present on query", http.StatusBadRequest)
 			return
 		}
-		sfKey := streamQ + "\x00" + tzQ + "\x00" + clientIP(r)
+		st, ok := findStream(p.streams, streamQ)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Stream %s not found", streamQ), http.StatusNotFound)
+			return
+		}
+		if _, err := st.dvrWindow(dvrQ); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// a token can't hold the playhead
+		if _, ok := p.sessions.(*tokenSessions); ok && dvrQ != "" {
+			http.Error(w, "dvr can't be used with token sessions", http.StatusBadRequest)
+			return
+		}
+		ts, err := srQ.timeshift(st, now)
+		if err != nil {
+			p.l.WithError(err).Debugf("finding offset")
+			http.Error(w, fmt.Sprintf("Error calculating offset: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		offset := ts.Offset(now)
+		if err := st.checkOffset(offset); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sfKey := streamQ + "\x00" + srQ.key() + "\x00" + dvrQ + "\x00" + clientIP(r)
 		v, err, _ := p.newEntrySF.Do(sfKey, func() (interface{}, error) {
-			nsid := uuid.New().String()
-			p.hlsSess.Set(ctx, nsid, sessionData{StreamID: streamQ, Timezone: tzQ})
-			return nsid, nil
+			s, err := p.indexer.SequenceFor(ctx, streamQ, now.Add(-offset))
+			if err != nil {
+				return nil, fmt.Errorf("getting sequence for %s: %w", streamQ, err)
+			}
+			return p.sessions.Create(ctx, sessionData{
+				StreamID:       streamQ,
+				Timezone:       srQ.Timezone,
+				Ahead:          srQ.Ahead,
+				Delay:          srQ.Delay,
+				At:             srQ.At,
+				DVR:            dvrQ,
+				Offset:         offset,
+				LatestSequence: s,
+				IntroducedAt:   now,
+			})
 		})
 		if err != nil {
-			p.l.WithError(err).Error("initial set session")
-			http.Error(w, "Internal error", http.StatusBadRequest)
+			serveEndpointErrorCount.WithLabelValues("hls", streamQ).Inc()
+			p.l.WithError(err).Error("creating session")
+			http.Error(w, "Internal error", http.StatusInternalServerError)
 			return
 		}
 		sid = v.(string)
@@ -78,39 +120,69 @@ func (p *playlist) ServePlaylist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sess := p.hlsSess.Get(ctx, sid)
+	sess, err := p.sessions.Get(ctx, sid)
+	if err != nil {
+		serveEndpointErrorCount.WithLabelValues("hls", sid).Inc()
+		p.l.WithError(err).Error("getting session")
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
 	if sess.StreamID == "" {
 		http.Error(w, "session not found or expired", http.StatusNotFound)
 		return
 	}
 
+	playhead := sess.PlayheadSequence
 	defer func() {
-		p.hlsSess.Set(ctx, sid, sess)
+		if err := p.sessions.Set(ctx, sid, sess); err != nil {
+			p.l.WithError(err).Error("saving session")
+		}
+		// the playhead is only ours to save if a jump cleared it
+		if playhead != 0 && sess.PlayheadSequence == 0 {
+			if err := p.sessions.SetPlayhead(ctx, sid, 0); err != nil {
+				p.l.WithError(err).Error("clearing playhead")
+			}
+		}
 	}()
 
 	streamID := sess.StreamID
-	tzStr := sess.Timezone
 
-	var baseTZ string
-	for _, s := range p.streams {
-		if s.ID == streamID {
-			baseTZ = s.BaseTimezone
-			break
-		}
-	}
-	if baseTZ == "" {
+	st, ok := findStream(p.streams, streamID)
+	if !ok {
 		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
 		return
 	}
 
-	offset, err := offsetForTimezone(baseTZ, tzStr)
+	// streams recording variants get a master playlist, and the session
+	// moves through the primary variant with the others lined up against it.
+	var variant streamVariant
+	if vs := p.indexer.Variants(streamID); len(vs) > 0 {
+		vq := r.URL.Query().Get("variant")
+		if vq == "" {
+			p.serveMasterPlaylist(w, sid, vs)
+			return
+		}
+		variant, ok = findVariant(vs, vq)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Variant %s not found", vq), http.StatusNotFound)
+			return
+		}
+	}
+
+	ts, err := sess.shiftRequest().timeshift(st, now)
 	if err != nil {
 		p.l.WithError(err).Debugf("finding offset")
 		http.Error(w, fmt.Sprintf("Error calculating offset: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
 
-	if sess.LatestSequence == 0 {
+	dvr, err := st.dvrWindow(sess.DVR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if offset, changed := ts.Next(sess.Offset, now); changed && st.checkOffset(offset) == nil {
 		s, err := p.indexer.SequenceFor(ctx, streamID, now.Add(-offset))
 		if err != nil {
 			serveEndpointErrorCount.WithLabelValues("hls", sid).Inc()
@@ -118,8 +190,16 @@ func (p *playlist) ServePlaylist(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Internal Error", http.StatusInternalServerError)
 			return
 		}
-		sess.LatestSequence = s
-		sess.IntroducedAt = now
+		p.l.Debugf("session %s offset changed from %s to %s, moving from seq %d to %d", sid, sess.Offset, offset, sess.LatestSequence, s)
+		sess.jumpTo(s, now, serveChunks)
+		sess.Offset = offset
+	}
+
+	if err := p.catchUp(ctx, &sess, now); err != nil {
+		serveEndpointErrorCount.WithLabelValues("hls", sid).Inc()
+		p.l.WithError(err).Error("catching up session")
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
 	}
 
 	rcs, err := p.indexer.Chunks(ctx, streamID, sess.LatestSequence, serveChunks*2)
@@ -145,6 +225,7 @@ func (p *playlist) ServePlaylist(w http.ResponseWriter, r *http.Request) {
 		for serveIdx < len(rcs)-serveChunks {
 			chunkDur := time.Duration(rcs[serveIdx].Duration * float64(time.Second))
 			if sess.IntroducedAt.Before(now.Add(-chunkDur)) {
+				sess.markDiscontinuity(rcs[serveIdx])
 				sess.LatestSequence = rcs[serveIdx+1].Sequence
 				sess.IntroducedAt = sess.IntroducedAt.Add(chunkDur)
 				serveIdx++
@@ -154,20 +235,66 @@ func (p *playlist) ServePlaylist(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	window := rcs[serveIdx : serveIdx+serveChunks]
+	if dvr > 0 {
+		window, err = p.dvrWindow(ctx, &sess, window, dvr)
+		if err != nil {
+			serveEndpointErrorCount.WithLabelValues("hls", sid).Inc()
+			p.l.WithError(err).Error("getting dvr window")
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for _, s := range window {
+		sess.markDiscontinuity(s)
+	}
+	sess.trimDiscontinuities(window[0].Sequence + sess.SequenceShift)
+
+	// segs are the chunks served for the window, which differ for variants.
+	segs, segStream := window, streamID
+	if variant.ID != "" {
+		window, segs = p.variantWindow(variant, window)
+		if len(segs) == 0 {
+			serveEndpointErrorCount.WithLabelValues("hls", sid).Inc()
+			p.l.Errorf("no chunks for variant %s", variant.ID)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		segStream = variant.ID
+	}
+	firstSeq := window[0].Sequence + sess.SequenceShift
+	discSeq := sess.DiscontinuitySequence
+	for _, ds := range sess.Discontinuities {
+		if ds < firstSeq {
+			discSeq++
+		}
+	}
+
 	pl := m3u8.Playlist{
 		Cache:    new(true),
-		Sequence: sess.LatestSequence,
+		Sequence: firstSeq,
 		Version:  new(4), // TODO - when would it not be?
-		Target:   maxDuration(rcs),
+		Target:   max(maxDuration(rcs), maxDuration(segs)),
 		Live:     true,
 	}
+	if discSeq > 0 {
+		pl.DiscontinuitySequence = new(discSeq)
+	}
 
-	for i := serveIdx; i < serveChunks+serveIdx; i++ {
-		s := rcs[i]
-		segURL := fmt.Sprintf("/chunk?stream=%s&chunk=%s", url.QueryEscape(streamID), url.QueryEscape(s.ChunkID))
+	for i, s := range window {
+		if slices.Contains(sess.Discontinuities, s.Sequence+sess.SequenceShift) {
+			pl.AppendItem(&m3u8.DiscontinuityItem{})
+		}
+		seg := segs[i]
+		segURL := chunkURL(segStream, seg.ChunkID)
+		if dvr > 0 {
+			// so ServeChunk can track where the player actually is
+			segURL += "&sid=" + url.QueryEscape(sid)
+		}
 		pl.AppendItem(&m3u8.SegmentItem{
 			Segment:  segURL,
-			Duration: s.Duration,
+			Duration: seg.Duration,
 		})
 	}
 
@@ -179,7 +306,59 @@ func (p *playlist) ServePlaylist(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, pl.String())
 }
 
-// ServeChunk redirects the user to the presigned S3 URL for a specific chunk.
+// catchUp moves a session forward to the chunk that should be playing at now,
+// leaving the last few for the normal advance in ServePlaylist. Stored sessions
+// are usually already there, but token sessions restart from where they joined
+// on every poll, so it seeks straight to the chunk playing now rather than
+// walking there. That's the chunk the session is on, plus the time since it
+// was introduced, which is now less the offset unless the recording has gaps.
+// If the chunk the session is on has been collected, it is re-anchored from
+// its offset.
+func (p *playlist) catchUp(ctx context.Context, sess *sessionData, now time.Time) error {
+	rcs, err := p.indexer.Chunks(ctx, sess.StreamID, sess.LatestSequence, 1)
+	if err != nil || len(rcs) == 0 {
+		return err
+	}
+	if rcs[0].Sequence != sess.LatestSequence {
+		s, err := p.indexer.SequenceFor(ctx, sess.StreamID, now.Add(-sess.Offset))
+		if err != nil {
+			return err
+		}
+		sess.LatestSequence = s
+		sess.IntroducedAt = now
+		return nil
+	}
+
+	at := rcs[0].FetchedAt.Add(now.Sub(sess.IntroducedAt))
+	target, err := p.indexer.SequenceFor(ctx, sess.StreamID, at)
+	if err != nil {
+		return err
+	}
+	// keep a full window after it
+	ahead, err := p.indexer.Chunks(ctx, sess.StreamID, target, serveChunks*2)
+	if err != nil {
+		return err
+	}
+	target -= serveChunks*2 - len(ahead)
+	if target-sess.LatestSequence <= serveChunks {
+		return nil
+	}
+	tcs, err := p.indexer.Chunks(ctx, sess.StreamID, target, 1)
+	if err != nil || len(tcs) == 0 {
+		return err
+	}
+	// token sessions won't have seen these go by, so make sure they're
+	// counted in the discontinuity sequence.
+	for _, rc := range p.indexer.DiscontinuitiesBetween(sess.StreamID, sess.LatestSequence, tcs[0].Sequence) {
+		sess.markDiscontinuity(rc)
+	}
+	sess.LatestSequence = tcs[0].Sequence
+	sess.IntroducedAt = now.Add(-at.Sub(tcs[0].FetchedAt))
+	return nil
+}
+
+// ServeChunk hands a specific chunk to the store to serve, either as a
+// redirect to a presigned S3 URL or directly.
 func (p *playlist) ServeChunk(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
@@ -199,15 +378,21 @@ func (p *playlist) ServeChunk(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	segURL, err := p.store.PresignedGET(r.Context(), rc)
-	if err != nil {
+	if sid := r.URL.Query().Get("sid"); sid != "" {
+		p.trackPlayhead(r.Context(), sid, streamID, rc)
+	}
+
+	if err := p.store.ServeChunk(w, r, rc); err != nil {
 		serveEndpointErrorCount.WithLabelValues("hls_chunk", streamID).Inc()
-		p.l.WithError(err).Error("presigning segment URL")
+		p.l.WithError(err).Error("serving chunk")
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
+}
 
-	http.Redirect(w, r, segURL, http.StatusTemporaryRedirect)
+// chunkURL is the path for fetching a chunk via ServeChunk.
+func chunkURL(streamID, chunkID string) string {
+	return fmt.Sprintf("/chunk?stream=%s&chunk=%s", url.QueryEscape(streamID), url.QueryEscape(chunkID))
 }
 
 func clientIP(r *http.Request) string {
@@ -231,21 +416,3 @@ func maxDuration(sg []recordedChunk) int {
 	}
 	return int(max)
 }
-
-func offsetForTimezone(baseTZ, userTZ string) (time.Duration, error) {
-	tz, err := time.LoadLocation(userTZ)
-	if err != nil {
-		return 0, fmt.Errorf("finding user timezone %s: %v", userTZ, err)
-	}
-
-	t := time.Date(1981, 12, 6, 01, 00, 00, 00, tz)
-
-	btz, err := time.LoadLocation(baseTZ)
-	if err != nil {
-		return 0, fmt.Errorf("finding base timezone %s: %v", baseTZ, err)
-	}
-
-	bt := time.Date(1981, 12, 6, 01, 00, 00, 00, btz)
-
-	return t.Sub(bt), nil
-}
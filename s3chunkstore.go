@@ -3,13 +3,23 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"sort"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	_ chunkStore   = (*s3ChunkStore)(nil)
+	_ objectLister = (*s3ChunkStore)(nil)
 )
 
 // s3ChunkStore uploads segments to S3-compatible storage and issues presigned GET URLs.
@@ -36,59 +46,79 @@ func newS3ChunkStore(client *s3.Client, bucket string, presignTTL time.Duration,
 
 // LoadStream lists existing objects for a stream and rebuilds the in-memory index.
 func (s *s3ChunkStore) LoadStream(ctx context.Context, streamID string) error {
+	return loadStoredStream(ctx, s, s.idx, streamID)
+}
+
+// ListStreams lists the top-level prefixes in the bucket.
+func (s *s3ChunkStore) ListStreams(ctx context.Context) ([]string, error) {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Delimiter: aws.String("/"),
+	})
+	var ids []string
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list streams: %w", err)
+		}
+		for _, cp := range out.CommonPrefixes {
+			id := strings.TrimSuffix(aws.ToString(cp.Prefix), "/")
+			if id != "" && !isReserved(id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// ListObjects lists every object under the stream's prefix.
+func (s *s3ChunkStore) ListObjects(ctx context.Context, streamID string) ([]storedObject, error) {
 	prefix := streamID + "/"
 	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucket),
 		Prefix: aws.String(prefix),
 	})
-	type row struct {
-		keyTime time.Time
-		rc      recordedChunk
-	}
-	var rows []row
+	var objs []storedObject
 	for paginator.HasMorePages() {
 		out, err := paginator.NextPage(ctx)
 		if err != nil {
-			return fmt.Errorf("list %s: %w", streamID, err)
+			return nil, fmt.Errorf("list %s: %w", streamID, err)
 		}
 		for _, obj := range out.Contents {
 			if obj.Key == nil || obj.LastModified == nil {
 				continue
 			}
-			_, kt, dur, chunkID, err := decodeObjectKey(*obj.Key)
-			if err != nil {
-				continue
-			}
-			lm := *obj.LastModified
-			rows = append(rows, row{
-				keyTime: kt,
-				rc: recordedChunk{
-					ChunkID:   chunkID,
-					Duration:  dur,
-					FetchedAt: lm.UTC(),
-					ObjectKey: *obj.Key,
-				},
-			})
+			objs = append(objs, storedObject{Key: *obj.Key, LastModified: *obj.LastModified, Size: aws.ToInt64(obj.Size)})
 		}
 	}
-	sort.Slice(rows, func(i, j int) bool {
-		if !rows[i].keyTime.Equal(rows[j].keyTime) {
-			return rows[i].keyTime.Before(rows[j].keyTime)
-		}
-		return rows[i].rc.ObjectKey < rows[j].rc.ObjectKey
+	return objs, nil
+}
+
+// RenameObject copies an object to a new key and deletes the original. S3 has
+// no rename, so there is a brief window where both exist.
+func (s *s3ChunkStore) RenameObject(ctx context.Context, from, to string) error {
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		CopySource: aws.String((&url.URL{Path: s.bucket + "/" + from}).EscapedPath()),
+		Key:        aws.String(to),
 	})
-	chunks := make([]recordedChunk, len(rows))
-	for i := range rows {
-		chunks[i] = rows[i].rc
-		chunks[i].Sequence = i + 1
+	if err != nil {
+		return fmt.Errorf("copy %s to %s: %w", from, to, err)
 	}
-	s.idx.ReplaceStream(streamID, chunks)
-	return nil
+	return s.DeleteObject(ctx, from)
 }
 
-// FetcherStore returns chunk storage for one stream's fetcher.
-func (s *s3ChunkStore) FetcherStore(streamID string) *stationChunkStore {
-	return &stationChunkStore{streamID: streamID, parent: s}
+// PutObject uploads a segment body.
+func (s *s3ChunkStore) PutObject(ctx context.Context, objectKey string, body []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(objectKey),
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		return fmt.Errorf("put %s: %w", objectKey, err)
+	}
+	return nil
 }
 
 // PresignedGET returns a time-limited URL to download the segment.
@@ -103,6 +133,37 @@ func (s *s3ChunkStore) PresignedGET(ctx context.Context, rc recordedChunk) (stri
 	return out.URL, nil
 }
 
+// ServeChunk redirects the user to the presigned S3 URL for the chunk.
+func (s *s3ChunkStore) ServeChunk(w http.ResponseWriter, r *http.Request, rc recordedChunk) error {
+	segURL, err := s.PresignedGET(r.Context(), rc)
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, segURL, http.StatusTemporaryRedirect)
+	return nil
+}
+
+// GetObject reads an object from the bucket.
+func (s *s3ChunkStore) GetObject(ctx context.Context, objectKey string) ([]byte, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, fmt.Errorf("get %s: %w", objectKey, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("get %s: %w", objectKey, err)
+	}
+	defer out.Body.Close()
+	b, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", objectKey, err)
+	}
+	return b, nil
+}
+
 // GetObjectReader streams an object body (e.g. for ICY).
 func (s *s3ChunkStore) GetObjectReader(ctx context.Context, rc recordedChunk) (io.ReadCloser, error) {
 	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
@@ -126,41 +187,3 @@ func (s *s3ChunkStore) DeleteObject(ctx context.Context, objectKey string) error
 	}
 	return nil
 }
-
-type stationChunkStore struct {
-	streamID string
-	parent   *s3ChunkStore
-}
-
-func (s *stationChunkStore) WriteChunk(ctx context.Context, chunkName string, chunkDuration float64, r io.Reader) error {
-	if s.parent.idx.HasLogical(s.streamID, chunkName) {
-		return nil
-	}
-	seq := s.parent.idx.NextSequence(s.streamID)
-	ts := time.Now().UTC()
-	key := encodeObjectKey(s.streamID, ts, chunkDuration, chunkName)
-	body, err := io.ReadAll(r)
-	if err != nil {
-		return fmt.Errorf("read chunk body: %w", err)
-	}
-	_, err = s.parent.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(s.parent.bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(body),
-	})
-	if err != nil {
-		return fmt.Errorf("put %s: %w", key, err)
-	}
-	s.parent.idx.Append(s.streamID, recordedChunk{
-		Sequence:  seq,
-		ChunkID:   chunkName,
-		Duration:  chunkDuration,
-		FetchedAt: ts,
-		ObjectKey: key,
-	})
-	return nil
-}
-
-func (s *stationChunkStore) ChunkExists(_ context.Context, chunkName string) bool {
-	return s.parent.idx.HasLogical(s.streamID, chunkName)
-}
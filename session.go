@@ -2,19 +2,113 @@ package main
 
 import (
 	"context"
+	"slices"
 	"sync"
 	"time"
+
+	"github.com/google/uuid"
 )
 
-// sessionData is per-listener HLS state (one random sid per player), held only in RAM.
-// Process restart or pod loss clears all sessions; clients re-hit ?stream=&tz= like a new ICY connection.
+// sessionData is per-listener HLS state (one sid per player), held in a
+// sessionStore. With the in-memory store a process restart or pod loss clears
+// all sessions; clients re-hit ?stream=&tz= like a new ICY connection.
 type sessionData struct {
 	LatestSequence int
 	IntroducedAt   time.Time
 	StreamID       string
-	Timezone       string
+	// Timezone, Ahead, Delay and At are the shiftRequest from joining.
+	Timezone string
+	Ahead    string
+	Delay    string
+	At       string
+	// Offset is how far behind live the listener currently is.
+	Offset time.Duration
+	// SequenceShift is added to chunk sequences for the playlist's
+	// MEDIA-SEQUENCE, so it keeps increasing after a jump back in time.
+	SequenceShift int
+	// Discontinuities are playlist sequences that follow a jump, and
+	// DiscontinuitySequence counts those that have left the playlist.
+	Discontinuities       []int
+	DiscontinuitySequence int
+	// DVR is the ?dvr= window the listener asked for, if any.
+	DVR string
+	// PlayheadSequence is the chunk a DVR player last fetched, 0 if unknown.
+	PlayheadSequence int
+}
+
+// shiftRequest returns the shift the listener asked for when they joined.
+func (d sessionData) shiftRequest() shiftRequest {
+	return shiftRequest{Timezone: d.Timezone, Ahead: d.Ahead, Delay: d.Delay, At: d.At}
+}
+
+// jumpTo moves the session to play from seq at the given time, e.g. after a DST
+// change. MEDIA-SEQUENCE must never go backwards, so SequenceShift is raised
+// to number the new position after the served segments, and the jump is
+// recorded as a discontinuity.
+func (d *sessionData) jumpTo(seq int, at time.Time, served int) {
+	next := d.LatestSequence + d.SequenceShift + served
+	if seq+d.SequenceShift < next {
+		d.SequenceShift = next - seq
+	}
+	d.LatestSequence = seq
+	d.IntroducedAt = at
+	d.PlayheadSequence = 0
+	d.Discontinuities = append(d.Discontinuities, seq+d.SequenceShift)
+}
+
+// markDiscontinuity records rc as following a discontinuity if the recording
+// has one there. Sessions pass chunks on a few paths, so it is safe to mark one
+// more than once.
+func (d *sessionData) markDiscontinuity(rc recordedChunk) {
+	seq := rc.Sequence + d.SequenceShift
+	if !rc.Discontinuity || slices.Contains(d.Discontinuities, seq) {
+		return
+	}
+	d.Discontinuities = append(d.Discontinuities, seq)
+	slices.Sort(d.Discontinuities)
+}
+
+// trimDiscontinuities drops recorded discontinuities before the playlist's
+// first sequence, counting them in DiscontinuitySequence.
+func (d *sessionData) trimDiscontinuities(first int) {
+	var keep []int
+	for _, ds := range d.Discontinuities {
+		if ds < first {
+			d.DiscontinuitySequence++
+			continue
+		}
+		keep = append(keep, ds)
+	}
+	d.Discontinuities = keep
+}
+
+// sessionStore keeps HLS session state between playlist polls.
+type sessionStore interface {
+	// Create stores a new session, returning the sid for it.
+	Create(ctx context.Context, d sessionData) (string, error)
+	// Get returns the session for sid, with an empty StreamID if it is
+	// unknown or expired.
+	Get(ctx context.Context, sid string) (sessionData, error)
+	// Set saves updated state for sid, apart from PlayheadSequence which is
+	// left as stored. Stores that can't update a session ignore it.
+	Set(ctx context.Context, sid string, d sessionData) error
+	// SetPlayhead saves only the PlayheadSequence for sid. It's set while
+	// chunks are fetched, so a playlist poll saving the rest of the session
+	// at the same time mustn't overwrite it.
+	SetPlayhead(ctx context.Context, sid string, seq int) error
+}
+
+// sessionPruner is a sessionStore that needs the GC to expire idle sessions.
+type sessionPruner interface {
+	// Prune removes sessions not updated since cutoff, returning how many.
+	Prune(ctx context.Context, cutoff time.Time) (int, error)
 }
 
+var (
+	_ sessionStore  = (*hlsSessions)(nil)
+	_ sessionPruner = (*hlsSessions)(nil)
+)
+
 type sessionEntry struct {
 	data      sessionData
 	updatedAt time.Time
@@ -30,22 +124,44 @@ func newHLSSessions() *hlsSessions {
 	return &hlsSessions{m: make(map[string]sessionEntry)}
 }
 
+// Create stores d under a new random sid.
+func (s *hlsSessions) Create(ctx context.Context, d sessionData) (string, error) {
+	sid := uuid.New().String()
+	return sid, s.Set(ctx, sid, d)
+}
+
 // Get returns session data or empty values if sid is unknown.
-func (s *hlsSessions) Get(_ context.Context, sid string) sessionData {
+func (s *hlsSessions) Get(_ context.Context, sid string) (sessionData, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	e, ok := s.m[sid]
 	if !ok {
-		return sessionData{}
+		return sessionData{}, nil
 	}
-	return e.data
+	return e.data, nil
 }
 
 // Set replaces state for sid and refreshes updatedAt (for idle GC).
-func (s *hlsSessions) Set(_ context.Context, sid string, d sessionData) {
+func (s *hlsSessions) Set(_ context.Context, sid string, d sessionData) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	d.PlayheadSequence = s.m[sid].data.PlayheadSequence
 	s.m[sid] = sessionEntry{data: d, updatedAt: time.Now().UTC()}
+	return nil
+}
+
+// SetPlayhead updates the playhead of a known session.
+func (s *hlsSessions) SetPlayhead(_ context.Context, sid string, seq int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[sid]
+	if !ok {
+		return nil
+	}
+	e.data.PlayheadSequence = seq
+	e.updatedAt = time.Now().UTC()
+	s.m[sid] = e
+	return nil
 }
 
 // replaceEntry overwrites a session (tests / simulating age).
@@ -55,8 +171,8 @@ func (s *hlsSessions) replaceEntry(sid string, d sessionData, at time.Time) {
 	s.m[sid] = sessionEntry{data: d, updatedAt: at.UTC()}
 }
 
-// pruneSessions removes sessions not updated since cutoff.
-func (s *hlsSessions) pruneSessions(cutoff time.Time) int {
+// Prune removes sessions not updated since cutoff.
+func (s *hlsSessions) Prune(_ context.Context, cutoff time.Time) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	cutoff = cutoff.UTC()
@@ -67,5 +183,5 @@ func (s *hlsSessions) pruneSessions(cutoff time.Time) int {
 			n++
 		}
 	}
-	return n
+	return n, nil
 }
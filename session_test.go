@@ -3,15 +3,48 @@ package main
 import (
 	"context"
 	"testing"
+	"time"
 )
 
 func TestSessionRoundTrip(t *testing.T) {
 	t.Parallel()
 	ctx := context.Background()
 	s := newHLSSessions()
-	s.Set(ctx, "123", sessionData{LatestSequence: 5, StreamID: "x", Timezone: "y"})
-	d := s.Get(ctx, "123")
+	if err := s.Set(ctx, "123", sessionData{LatestSequence: 5, StreamID: "x", Timezone: "y"}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := s.Get(ctx, "123")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if d.LatestSequence != 5 || d.StreamID != "x" {
 		t.Fatalf("got %#v", d)
 	}
 }
+
+func TestSessionJump(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+
+	// repeating an hour moves back in the index, but the playlist sequence
+	// has to carry on after the three segments already served.
+	d := sessionData{LatestSequence: 500}
+	d.jumpTo(140, now, 3)
+	if d.LatestSequence != 140 || d.LatestSequence+d.SequenceShift != 503 {
+		t.Fatalf("want seq 140 at playlist seq 503, got %d + %d", d.LatestSequence, d.SequenceShift)
+	}
+	if len(d.Discontinuities) != 1 || d.Discontinuities[0] != 503 {
+		t.Fatalf("want discontinuity at 503, got %v", d.Discontinuities)
+	}
+
+	// skipping forward needs no shift
+	d.jumpTo(900, now, 3)
+	if d.LatestSequence+d.SequenceShift != 900+363 {
+		t.Fatalf("want playlist seq %d, got %d", 900+363, d.LatestSequence+d.SequenceShift)
+	}
+
+	d.trimDiscontinuities(900 + 363)
+	if d.DiscontinuitySequence != 1 || len(d.Discontinuities) != 1 {
+		t.Errorf("want one trimmed and one remaining discontinuity, got %d %v", d.DiscontinuitySequence, d.Discontinuities)
+	}
+}
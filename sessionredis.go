@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// redisSessionPrefix namespaces session keys, and redisPlayheadPrefix the
+// keys holding each session's playhead, kept apart so it can be set alone.
+const (
+	redisSessionPrefix  = "tjts:session:"
+	redisPlayheadPrefix = "tjts:playhead:"
+)
+
+var _ sessionStore = (*redisSessions)(nil)
+
+// redisSessions keeps HLS sessions in anything that speaks the Redis protocol.
+// Keys expire on their own after maxAge idle, so there is nothing to prune.
+type redisSessions struct {
+	client *redisClient
+	maxAge time.Duration
+}
+
+func newRedisSessions(client *redisClient, maxAge time.Duration) *redisSessions {
+	return &redisSessions{client: client, maxAge: maxAge}
+}
+
+// Create stores d under a new random sid.
+func (s *redisSessions) Create(ctx context.Context, d sessionData) (string, error) {
+	sid := uuid.New().String()
+	return sid, s.Set(ctx, sid, d)
+}
+
+// Get returns session data or empty values if sid is unknown.
+func (s *redisSessions) Get(ctx context.Context, sid string) (sessionData, error) {
+	v, err := s.client.Do(ctx, "MGET", redisSessionPrefix+sid, redisPlayheadPrefix+sid)
+	if err != nil {
+		return sessionData{}, fmt.Errorf("get session %s: %w", sid, err)
+	}
+	vs, _ := v.([]any)
+	if len(vs) != 2 {
+		return sessionData{}, fmt.Errorf("get session %s: unexpected reply %v", sid, v)
+	}
+	b, ok := vs[0].([]byte)
+	if !ok {
+		return sessionData{}, nil
+	}
+	var d sessionData
+	if err := json.Unmarshal(b, &d); err != nil {
+		return sessionData{}, fmt.Errorf("decoding session %s: %w", sid, err)
+	}
+	if ph, ok := vs[1].([]byte); ok {
+		d.PlayheadSequence, _ = strconv.Atoi(string(ph))
+	}
+	return d, nil
+}
+
+// Set replaces state for sid and restarts its expiry.
+func (s *redisSessions) Set(ctx context.Context, sid string, d sessionData) error {
+	// the playhead lives in its own key
+	d.PlayheadSequence = 0
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.Do(ctx, "SET", redisSessionPrefix+sid, string(b), "EX", s.expiry()); err != nil {
+		return fmt.Errorf("set session %s: %w", sid, err)
+	}
+	return nil
+}
+
+// SetPlayhead sets the playhead's own key, expiring like the session.
+func (s *redisSessions) SetPlayhead(ctx context.Context, sid string, seq int) error {
+	if _, err := s.client.Do(ctx, "SET", redisPlayheadPrefix+sid, strconv.Itoa(seq), "EX", s.expiry()); err != nil {
+		return fmt.Errorf("set playhead %s: %w", sid, err)
+	}
+	return nil
+}
+
+func (s *redisSessions) expiry() string {
+	return strconv.Itoa(max(int(s.maxAge/time.Second), 1))
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisMaxIdle is how many idle connections redisClient keeps.
+const redisMaxIdle = 8
+
+// redisClient is a minimal RESP client, just enough for sessions.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newRedisClient(addr, password string, db int) *redisClient {
+	return &redisClient{
+		addr:     addr,
+		password: password,
+		db:       db,
+		idle:     make(chan *redisConn, redisMaxIdle),
+	}
+}
+
+// Do runs a command, returning the reply as nil, string, int64, []byte or
+// []any.
+func (c *redisClient) Do(ctx context.Context, args ...string) (any, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := conn.do(ctx, args...)
+	var re redisError
+	if err != nil && !errors.As(err, &re) {
+		// the connection is in an unknown state
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return v, err
+}
+
+func (c *redisClient) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing redis %s: %w", c.addr, err)
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err := conn.do(ctx, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis auth: %w", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis select %d: %w", c.db, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) do(ctx context.Context, args ...string) (any, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	} else {
+		c.SetDeadline(time.Time{})
+	}
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, a := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return readRESP(c.r)
+}
+
+// readRESP reads one RESP reply.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	typ, body := line[0], line[1:len(line)-2]
+	switch typ {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("malformed bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("malformed array length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		// an error element is returned once the rest of the array is read, so
+		// the connection is left ready for the next reply
+		out := make([]any, n)
+		var elemErr error
+		for i := range out {
+			v, err := readRESP(r)
+			var re redisError
+			if errors.As(err, &re) {
+				if elemErr == nil {
+					elemErr = err
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		if elemErr != nil {
+			return nil, elemErr
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", typ)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the handful of commands the session store uses.
+type fakeRedis struct {
+	password string
+
+	mu   sync.Mutex
+	data map[string]string
+	ttls map[string]int
+}
+
+func startFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeRedis{password: password, data: map[string]string{}, ttls: map[string]int{}}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f, ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := f.password == ""
+	for {
+		v, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		args, ok := v.([]any)
+		if !ok || len(args) == 0 {
+			io.WriteString(c, "-ERR bad command\r\n")
+			continue
+		}
+		var cmd []string
+		for _, a := range args {
+			cmd = append(cmd, string(a.([]byte)))
+		}
+
+		f.mu.Lock()
+		switch {
+		case strings.EqualFold(cmd[0], "AUTH"):
+			authed = cmd[1] == f.password
+			if authed {
+				io.WriteString(c, "+OK\r\n")
+			} else {
+				io.WriteString(c, "-WRONGPASS invalid password\r\n")
+			}
+		case !authed:
+			io.WriteString(c, "-NOAUTH Authentication required.\r\n")
+		case strings.EqualFold(cmd[0], "GET"):
+			if d, ok := f.data[cmd[1]]; ok {
+				fmt.Fprintf(c, "$%d\r\n%s\r\n", len(d), d)
+			} else {
+				io.WriteString(c, "$-1\r\n")
+			}
+		case strings.EqualFold(cmd[0], "MGET"):
+			fmt.Fprintf(c, "*%d\r\n", len(cmd)-1)
+			for _, k := range cmd[1:] {
+				if d, ok := f.data[k]; ok {
+					fmt.Fprintf(c, "$%d\r\n%s\r\n", len(d), d)
+				} else {
+					io.WriteString(c, "$-1\r\n")
+				}
+			}
+		case strings.EqualFold(cmd[0], "SET"):
+			f.data[cmd[1]] = cmd[2]
+			if len(cmd) == 5 && strings.EqualFold(cmd[3], "EX") {
+				f.ttls[cmd[1]], _ = strconv.Atoi(cmd[4])
+			}
+			io.WriteString(c, "+OK\r\n")
+		default:
+			fmt.Fprintf(c, "-ERR unknown command '%s'\r\n", cmd[0])
+		}
+		f.mu.Unlock()
+	}
+}
+
+func TestRedisSessions(t *testing.T) {
+	ctx := context.Background()
+	f, addr := startFakeRedis(t, "hunter2")
+
+	rs := newRedisSessions(newRedisClient(addr, "hunter2", 0), time.Hour)
+	sid, err := rs.Create(ctx, sessionData{StreamID: "s", Timezone: "Australia/Perth", LatestSequence: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another replica sees it
+	other := newRedisSessions(newRedisClient(addr, "hunter2", 0), time.Hour)
+	d, err := other.Get(ctx, sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.StreamID != "s" || d.Timezone != "Australia/Perth" || d.LatestSequence != 42 {
+		t.Errorf("got %#v", d)
+	}
+
+	f.mu.Lock()
+	ttl := f.ttls[redisSessionPrefix+sid]
+	f.mu.Unlock()
+	if ttl != 3600 {
+		t.Errorf("want 3600s expiry, got %d", ttl)
+	}
+
+	d, err = rs.Get(ctx, "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.StreamID != "" {
+		t.Errorf("want unknown session, got %#v", d)
+	}
+
+	bad := newRedisSessions(newRedisClient(addr, "wrong", 0), time.Hour)
+	if _, err := bad.Get(ctx, sid); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("want auth error, got %v", err)
+	}
+}
+
+func TestReadRESPArrayError(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*3\r\n$1\r\na\r\n-ERR nope\r\n:1\r\n+OK\r\n"))
+	if _, err := readRESP(r); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("want the element's error, got %v", err)
+	}
+	// the rest of the array was read, so the next reply is intact
+	if v, err := readRESP(r); err != nil || v != "OK" {
+		t.Errorf("want OK, got %v %v", v, err)
+	}
+}
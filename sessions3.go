@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+// s3SessionPrefix is where sessions are kept in the bucket. Each session's
+// playhead is kept in its own object with s3PlayheadSuffix, so it can be set
+// alone.
+const (
+	s3SessionPrefix  = reservedPrefix + "sessions/"
+	s3PlayheadSuffix = ".playhead"
+)
+
+var (
+	_ sessionStore  = (*s3Sessions)(nil)
+	_ sessionPruner = (*s3Sessions)(nil)
+)
+
+// s3SessionClient is the part of the S3 API sessions use.
+type s3SessionClient interface {
+	s3.ListObjectsV2APIClient
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// s3Sessions keeps each HLS session as a JSON object in the chunk bucket, so
+// sessions survive restarts and are shared between replicas.
+type s3Sessions struct {
+	client s3SessionClient
+	bucket string
+	maxAge time.Duration
+
+	mu sync.Mutex
+	// sid -> the session as last read or written, so Set can skip writing it
+	// back unchanged on every poll.
+	stored map[string]storedSession
+}
+
+// storedSession is the hash of a session object's body, and when it was
+// written.
+type storedSession struct {
+	sum [sha256.Size]byte
+	at  time.Time
+}
+
+func newS3Sessions(client s3SessionClient, bucket string, maxAge time.Duration) *s3Sessions {
+	return &s3Sessions{client: client, bucket: bucket, maxAge: maxAge, stored: make(map[string]storedSession)}
+}
+
+// Create stores d under a new random sid.
+func (s *s3Sessions) Create(ctx context.Context, d sessionData) (string, error) {
+	sid := uuid.New().String()
+	return sid, s.Set(ctx, sid, d)
+}
+
+// Get returns session data or empty values if sid is unknown.
+func (s *s3Sessions) Get(ctx context.Context, sid string) (sessionData, error) {
+	if _, err := uuid.Parse(sid); err != nil {
+		return sessionData{}, nil
+	}
+	b, at, err := s.get(ctx, s3SessionPrefix+sid)
+	if err != nil || b == nil {
+		return sessionData{}, err
+	}
+	s.remember(sid, b, at)
+	var d sessionData
+	if err := json.Unmarshal(b, &d); err != nil {
+		return sessionData{}, fmt.Errorf("decoding session %s: %w", sid, err)
+	}
+	ph, _, err := s.get(ctx, s3SessionPrefix+sid+s3PlayheadSuffix)
+	if err != nil {
+		return sessionData{}, err
+	}
+	if ph != nil {
+		d.PlayheadSequence, _ = strconv.Atoi(string(ph))
+	}
+	return d, nil
+}
+
+// get returns an object's body and last modified time, or nil if there's no
+// such object.
+func (s *s3Sessions) get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, time.Time{}, nil
+		}
+		return nil, time.Time{}, fmt.Errorf("get %s: %w", key, err)
+	}
+	defer out.Body.Close()
+	b, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("reading %s: %w", key, err)
+	}
+	return b, aws.ToTime(out.LastModified), nil
+}
+
+// remember notes the body of sid's session object as of at.
+func (s *s3Sessions) remember(sid string, b []byte, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stored[sid] = storedSession{sum: sha256.Sum256(b), at: at}
+}
+
+// Set replaces state for sid. The object's last modified time is used for
+// idle GC, so it's only written if it has changed, or to keep it from looking
+// idle once it's half way to maxAge.
+func (s *s3Sessions) Set(ctx context.Context, sid string, d sessionData) error {
+	// the playhead lives in its own object
+	d.PlayheadSequence = 0
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	prev, ok := s.stored[sid]
+	s.mu.Unlock()
+	if ok && prev.sum == sha256.Sum256(b) && time.Since(prev.at) < s.maxAge/2 {
+		return nil
+	}
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s3SessionPrefix + sid),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("put session %s: %w", sid, err)
+	}
+	s.remember(sid, b, time.Now())
+	return nil
+}
+
+// SetPlayhead replaces the playhead object for sid.
+func (s *s3Sessions) SetPlayhead(ctx context.Context, sid string, seq int) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s3SessionPrefix + sid + s3PlayheadSuffix),
+		Body:        strings.NewReader(strconv.Itoa(seq)),
+		ContentType: aws.String("text/plain"),
+	})
+	if err != nil {
+		return fmt.Errorf("put playhead %s: %w", sid, err)
+	}
+	return nil
+}
+
+// Prune deletes sessions, and their playheads, not updated since cutoff.
+func (s *s3Sessions) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s3SessionPrefix),
+	})
+	var n int
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return n, fmt.Errorf("list sessions: %w", err)
+		}
+		for _, obj := range out.Contents {
+			if obj.Key == nil || obj.LastModified == nil || !obj.LastModified.Before(cutoff) {
+				continue
+			}
+			if _, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    obj.Key,
+			}); err != nil {
+				return n, fmt.Errorf("delete session %s: %w", *obj.Key, err)
+			}
+			n++
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sid, ss := range s.stored {
+		if ss.at.Before(cutoff) {
+			delete(s.stored, sid)
+		}
+	}
+	return n, nil
+}
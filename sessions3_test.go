@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type fakeS3Object struct {
+	body     []byte
+	modified time.Time
+}
+
+// fakeS3 is an in-memory bucket with just enough of the API for sessions.
+type fakeS3 struct {
+	mu   sync.Mutex
+	objs map[string]fakeS3Object
+	puts int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objs: make(map[string]fakeS3Object)}
+}
+
+func (f *fakeS3) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objs[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(o.body)), LastModified: aws.Time(o.modified)}, nil
+}
+
+func (f *fakeS3) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	b, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objs[aws.ToString(in.Key)] = fakeS3Object{body: b, modified: time.Now()}
+	f.puts++
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObject(_ context.Context, in *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objs, aws.ToString(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.ListObjectsV2Output{}
+	for k, o := range f.objs {
+		if strings.HasPrefix(k, aws.ToString(in.Prefix)) {
+			out.Contents = append(out.Contents, types.Object{Key: aws.String(k), LastModified: aws.Time(o.modified), Size: aws.Int64(int64(len(o.body)))})
+		}
+	}
+	sort.Slice(out.Contents, func(i, j int) bool { return *out.Contents[i].Key < *out.Contents[j].Key })
+	return out, nil
+}
+
+// age makes the objects under prefix look like they were written d earlier.
+func (f *fakeS3) age(prefix string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, o := range f.objs {
+		if strings.HasPrefix(k, prefix) {
+			o.modified = o.modified.Add(-d)
+			f.objs[k] = o
+		}
+	}
+}
+
+func TestS3Sessions(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeS3()
+	ss := newS3Sessions(client, "bucket", time.Hour)
+
+	want := sessionData{StreamID: "s", Timezone: "Australia/Perth", Offset: 2 * time.Hour, LatestSequence: 42}
+	sid, err := ss.Create(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another replica on the same bucket can read it
+	other := newS3Sessions(client, "bucket", time.Hour)
+	got, err := other.Get(ctx, sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.StreamID != want.StreamID || got.Timezone != want.Timezone || got.Offset != want.Offset || got.LatestSequence != want.LatestSequence {
+		t.Errorf("want %#v, got %#v", want, got)
+	}
+	for _, unknown := range []string{"not-a-uuid", "5b0d4a7e-4f5d-4b44-9a3c-0d1f0e3b9c11"} {
+		if got, err := ss.Get(ctx, unknown); err != nil || got.StreamID != "" {
+			t.Errorf("%s: want unknown session, got %#v %v", unknown, got, err)
+		}
+	}
+
+	// saving it back unchanged, as every poll does, doesn't write
+	puts := client.puts
+	if err := other.Set(ctx, sid, got); err != nil {
+		t.Fatal(err)
+	}
+	if client.puts != puts {
+		t.Errorf("want an unchanged session not written, got %d puts", client.puts-puts)
+	}
+	got.LatestSequence++
+	if err := other.Set(ctx, sid, got); err != nil {
+		t.Fatal(err)
+	}
+	if client.puts != puts+1 {
+		t.Errorf("want a changed session written, got %d puts", client.puts-puts)
+	}
+
+	// the playhead is kept apart, and survives a save of the session
+	if err := ss.SetPlayhead(ctx, sid, 40); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ss.Get(ctx, sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LatestSequence != 43 || got.PlayheadSequence != 40 {
+		t.Errorf("want sequence 43 with the playhead at 40, got %#v", got)
+	}
+	got.Offset = time.Hour
+	if err := ss.Set(ctx, sid, got); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ss.Get(ctx, sid); got.Offset != time.Hour || got.PlayheadSequence != 40 {
+		t.Errorf("want the new offset with the playhead kept, got %#v", got)
+	}
+
+	// an unchanged session is written again once it's getting old, so it
+	// isn't pruned while it's in use
+	client.age(s3SessionPrefix, 40*time.Minute)
+	got, _ = ss.Get(ctx, sid)
+	puts = client.puts
+	if err := ss.Set(ctx, sid, got); err != nil {
+		t.Fatal(err)
+	}
+	if client.puts != puts+1 {
+		t.Errorf("want an ageing session written again, got %d puts", client.puts-puts)
+	}
+
+	old, err := ss.Create(ctx, sessionData{StreamID: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.SetPlayhead(ctx, old, 1); err != nil {
+		t.Fatal(err)
+	}
+	client.age(s3SessionPrefix+old, 2*time.Hour)
+	n, err := ss.Prune(ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("want the idle session and its playhead pruned, got %d", n)
+	}
+	if got, _ := ss.Get(ctx, old); got.StreamID != "" {
+		t.Errorf("want the pruned session gone, got %#v", got)
+	}
+	if got, _ := ss.Get(ctx, sid); got.StreamID != "s" {
+		t.Errorf("want the session in use kept, got %#v", got)
+	}
+}
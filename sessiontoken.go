@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// tokenSessions is a sessionStore that keeps nothing server side. The sid is
+// the session's join state, HMAC signed, so any replica can serve any poll.
+//
+// A player keeps polling the URL it was redirected to, so the token can never
+// be updated. It holds where the listener joined, and ServePlaylist walks
+// forward from there on every poll. Anything that changes after joining, like
+// a wallclock DST jump or a DVR playhead, is lost, so config rejects
+// dstPolicy wallclock and dvrWindow with token sessions, and ServePlaylist
+// rejects ?dvr=. Tokens expire maxAge after they're issued.
+type tokenSessions struct {
+	secret []byte
+	maxAge time.Duration
+}
+
+var _ sessionStore = (*tokenSessions)(nil)
+
+func newTokenSessions(secret string, maxAge time.Duration) (*tokenSessions, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("session secret must be at least 32 characters")
+	}
+	return &tokenSessions{secret: []byte(secret), maxAge: maxAge}, nil
+}
+
+// sessionToken is what a token carries, the session as it was on joining.
+type sessionToken struct {
+	StreamID     string        `json:"s"`
+	Timezone     string        `json:"tz,omitempty"`
+	Ahead        string        `json:"ah,omitempty"`
+	Delay        string        `json:"d,omitempty"`
+	At           string        `json:"at,omitempty"`
+	DVR          string        `json:"dvr,omitempty"`
+	Offset       time.Duration `json:"o"`
+	Sequence     int           `json:"q"`
+	IntroducedAt time.Time     `json:"i"`
+	IssuedAt     int64         `json:"iat"`
+}
+
+// Create encodes d as a signed token.
+func (t *tokenSessions) Create(_ context.Context, d sessionData) (string, error) {
+	b, err := json.Marshal(sessionToken{
+		StreamID:     d.StreamID,
+		Timezone:     d.Timezone,
+		Ahead:        d.Ahead,
+		Delay:        d.Delay,
+		At:           d.At,
+		DVR:          d.DVR,
+		Offset:       d.Offset,
+		Sequence:     d.LatestSequence,
+		IntroducedAt: d.IntroducedAt,
+		IssuedAt:     time.Now().Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(t.sign(payload)), nil
+}
+
+// Get verifies and decodes a token. Invalid and expired tokens are treated as
+// unknown sessions.
+func (t *tokenSessions) Get(_ context.Context, sid string) (sessionData, error) {
+	payload, sig, ok := strings.Cut(sid, ".")
+	if !ok {
+		return sessionData{}, nil
+	}
+	gotSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(gotSig, t.sign(payload)) {
+		return sessionData{}, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return sessionData{}, nil
+	}
+	var st sessionToken
+	if err := json.Unmarshal(b, &st); err != nil {
+		return sessionData{}, nil
+	}
+	if t.maxAge > 0 && time.Since(time.Unix(st.IssuedAt, 0)) > t.maxAge {
+		return sessionData{}, nil
+	}
+	return sessionData{
+		StreamID:       st.StreamID,
+		Timezone:       st.Timezone,
+		Ahead:          st.Ahead,
+		Delay:          st.Delay,
+		At:             st.At,
+		DVR:            st.DVR,
+		Offset:         st.Offset,
+		LatestSequence: st.Sequence,
+		IntroducedAt:   st.IntroducedAt,
+	}, nil
+}
+
+// Set does nothing, tokens can't be updated.
+func (t *tokenSessions) Set(context.Context, string, sessionData) error {
+	return nil
+}
+
+// SetPlayhead does nothing, tokens can't be updated.
+func (t *tokenSessions) SetPlayhead(context.Context, string, int) error {
+	return nil
+}
+
+func (t *tokenSessions) sign(payload string) []byte {
+	m := hmac.New(sha256.New, t.secret)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testSessionSecret = "0123456789abcdef0123456789abcdef"
+
+func TestTokenSessions(t *testing.T) {
+	ctx := context.Background()
+	ts, err := newTokenSessions(testSessionSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := sessionData{StreamID: "s", Timezone: "Australia/Perth", DVR: "10m", Offset: 2 * time.Hour, LatestSequence: 42, IntroducedAt: time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)}
+	sid, err := ts.Create(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a different replica with the same secret can read it
+	other, _ := newTokenSessions(testSessionSecret, time.Hour)
+	got, err := other.Get(ctx, sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.StreamID != want.StreamID || got.Timezone != want.Timezone || got.DVR != want.DVR || got.Offset != want.Offset ||
+		got.LatestSequence != want.LatestSequence || !got.IntroducedAt.Equal(want.IntroducedAt) {
+		t.Errorf("want %#v, got %#v", want, got)
+	}
+
+	wrong, _ := newTokenSessions(strings.Repeat("x", 32), time.Hour)
+	for name, tok := range map[string]string{
+		"wrong secret": sid,
+		"tampered":     "e30" + sid[3:],
+		"garbage":      "not-a-token",
+	} {
+		s := ts
+		if name == "wrong secret" {
+			s = wrong
+		}
+		got, err := s.Get(ctx, tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.StreamID != "" {
+			t.Errorf("%s: want unknown session, got %#v", name, got)
+		}
+	}
+
+	// a replica with a shorter max age sees it as expired
+	expiring, _ := newTokenSessions(testSessionSecret, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if got, err := expiring.Get(ctx, sid); err != nil || got.StreamID != "" {
+		t.Errorf("want an expired token treated as unknown, got %#v %v", got, err)
+	}
+
+	if _, err := newTokenSessions("short", time.Hour); err == nil {
+		t.Error("want error for short secret")
+	}
+}
+
+func TestTokenSessionPlaylist(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	idx := newChunkIndex()
+	for i := range 60 {
+		if err := idx.RecordChunk(ctx, "s", fmt.Sprintf("chunk-%d.ts", i+1), 10, now.Add(-10*time.Minute).Add(time.Duration(i)*10*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	streams := []configStream{{ID: "s", BaseTimezone: "UTC", Retention: retentionConfig{MaxAge: time.Hour}}}
+	ts, _ := newTokenSessions(testSessionSecret, time.Hour)
+	pl := newPlaylist(logrus.New(), streams, idx, nil, ts)
+
+	// joined two minutes ago at chunk 10, so should now be about 12 chunks on.
+	sid, err := ts.Create(ctx, sessionData{StreamID: "s", Delay: "9m", Offset: 9 * time.Minute, LatestSequence: 10, IntroducedAt: now.Add(-2*time.Minute - 5*time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	pl.ServePlaylist(rec, httptest.NewRequest("GET", "/m3u8?"+url.Values{"sid": {sid}}.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "#EXT-X-MEDIA-SEQUENCE:22") || !strings.Contains(body, chunkURL("s", "chunk-22.ts")) {
+		t.Errorf("want playlist from chunk 22:\n%s", body)
+	}
+	// there's nowhere to keep a DVR playhead
+	rec = httptest.NewRecorder()
+	pl.ServePlaylist(rec, httptest.NewRequest("GET", "/m3u8?"+url.Values{"stream": {"s"}, "delay": {"9m"}, "dvr": {"5m"}}.Encode(), nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "token sessions") {
+		t.Errorf("want 400 for dvr with token sessions, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTokenSessionLongRunning(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	idx := newChunkIndex()
+	for i := range 12 * 360 {
+		idx.Append("s", recordedChunk{Sequence: i + 1, ChunkID: fmt.Sprintf("chunk-%d.ts", i+1), Duration: 10, FetchedAt: now.Add(-12 * time.Hour).Add(time.Duration(i) * 10 * time.Second)})
+	}
+	streams := []configStream{{ID: "s", BaseTimezone: "UTC", Retention: retentionConfig{MaxAge: 24 * time.Hour}}}
+	ts, _ := newTokenSessions(testSessionSecret, 24*time.Hour)
+	pl := newPlaylist(logrus.New(), streams, idx, nil, ts)
+
+	// joined at the first chunk 11 hours ago, an hour behind
+	sid, err := ts.Create(ctx, sessionData{StreamID: "s", Delay: "1h", Offset: time.Hour, LatestSequence: 1, IntroducedAt: now.Add(-11*time.Hour - 5*time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	pl.ServePlaylist(rec, httptest.NewRequest("GET", "/m3u8?"+url.Values{"sid": {sid}}.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "#EXT-X-MEDIA-SEQUENCE:3961") {
+		t.Errorf("want playlist from the chunk an hour ago:\n%s", body)
+	}
+}
+
+func TestTokenSessionPlaylistGaps(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	idx := newChunkIndex()
+	for i := range 60 {
+		idx.Append("s", recordedChunk{
+			Sequence:  i + 1,
+			ChunkID:   fmt.Sprintf("chunk-%d.ts", i+1),
+			Duration:  10,
+			FetchedAt: now.Add(-10 * time.Minute).Add(time.Duration(i) * 10 * time.Second),
+			// one gap the session has already gone past, and one in the
+			// playlist it gets.
+			Discontinuity: i+1 == 15 || i+1 == 24,
+		})
+	}
+	streams := []configStream{{ID: "s", BaseTimezone: "UTC", Retention: retentionConfig{MaxAge: time.Hour}}}
+	ts, _ := newTokenSessions(testSessionSecret, time.Hour)
+	pl := newPlaylist(logrus.New(), streams, idx, nil, ts)
+
+	sid, err := ts.Create(ctx, sessionData{StreamID: "s", Delay: "9m", Offset: 9 * time.Minute, LatestSequence: 10, IntroducedAt: now.Add(-2*time.Minute - 5*time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	pl.ServePlaylist(rec, httptest.NewRequest("GET", "/m3u8?"+url.Values{"sid": {sid}}.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "#EXT-X-DISCONTINUITY-SEQUENCE:1") {
+		t.Errorf("want the gap before the playlist counted in the discontinuity sequence:\n%s", body)
+	}
+	disc := strings.Index(body, "#EXT-X-DISCONTINUITY\n")
+	if disc < 0 || disc < strings.Index(body, chunkURL("s", "chunk-23.ts")) || disc > strings.Index(body, chunkURL("s", "chunk-24.ts")) {
+		t.Errorf("want a discontinuity before chunk 24:\n%s", body)
+	}
+}
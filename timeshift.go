@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dstPolicy decides what a long-lived listener hears when the offset between
+// their timezone and the station's changes mid-stream, because one of them
+// started or stopped observing daylight saving.
+type dstPolicy string
+
+const (
+	// dstContinuous keeps the offset from when the listener joined. Audio
+	// never jumps, but it is an hour out from local time until they reconnect.
+	dstContinuous dstPolicy = "continuous"
+	// dstWallclock follows the listener's wall clock, repeating an hour when
+	// the offset grows and skipping one when it shrinks.
+	dstWallclock dstPolicy = "wallclock"
+)
+
+func (p dstPolicy) valid() bool {
+	return p == dstContinuous || p == dstWallclock
+}
+
+// aheadPolicy decides what listeners in a timezone ahead of the station hear.
+// Their local time hasn't been broadcast yet, so there is nothing to shift to.
+type aheadPolicy string
+
+const (
+	// aheadLive plays them the live stream.
+	aheadLive aheadPolicy = "live"
+	// aheadPreviousDay plays them the previous day's broadcast for their local
+	// time, 24h minus the offset ago. This needs a day of retention.
+	aheadPreviousDay aheadPolicy = "previousDay"
+)
+
+func (p aheadPolicy) valid() bool {
+	return p == aheadLive || p == aheadPreviousDay
+}
+
+// timeshift works out how far behind live a listener should be, so they hear
+// what the station broadcast at the same local time. ICY and HLS share it.
+type timeshift struct {
+	base     *time.Location
+	listener *time.Location
+	policy   dstPolicy
+	ahead    aheadPolicy
+	// fixed listeners asked for a delay or start time rather than a zone, and
+	// are always delay behind live.
+	fixed bool
+	delay time.Duration
+}
+
+func newTimeshift(baseTZ, userTZ string, policy dstPolicy, ahead aheadPolicy) (timeshift, error) {
+	tz, err := loadListenerLocation(userTZ)
+	if err != nil {
+		return timeshift{}, fmt.Errorf("finding user timezone %s: %v", userTZ, err)
+	}
+	btz, err := time.LoadLocation(baseTZ)
+	if err != nil {
+		return timeshift{}, fmt.Errorf("finding base timezone %s: %v", baseTZ, err)
+	}
+	if policy == "" {
+		policy = dstContinuous
+	}
+	if ahead == "" {
+		ahead = aheadLive
+	}
+	if !ahead.valid() {
+		return timeshift{}, fmt.Errorf("unknown ahead policy %q", ahead)
+	}
+	return timeshift{base: btz, listener: tz, policy: policy, ahead: ahead}, nil
+}
+
+// Offset returns the offset for the listener's wall clock at now. It is
+// negative for listeners ahead of the station, unless they are mapped to the
+// previous day.
+func (t timeshift) Offset(now time.Time) time.Duration {
+	if t.fixed {
+		return t.delay
+	}
+	o := wallclockOffset(t.base, t.listener, now)
+	if t.ahead == aheadPreviousDay {
+		for o < 0 {
+			o += 24 * time.Hour
+		}
+	}
+	return o
+}
+
+// Next returns the offset a listener currently on current should be on at
+// now, and whether that is a change, according to the DST policy.
+func (t timeshift) Next(current time.Duration, now time.Time) (time.Duration, bool) {
+	if t.fixed || t.policy != dstWallclock {
+		return current, false
+	}
+	o := t.Offset(now)
+	return o, o != current
+}
+
+// wallclockOffset finds when the base zone last showed the same wall clock time
+// the listener sees at now, and returns how long ago that was. Using the
+// actual instant means each zone's DST rules apply for the current date.
+func wallclockOffset(base, listener *time.Location, now time.Time) time.Duration {
+	lt := now.In(listener)
+	bt := time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), lt.Minute(), lt.Second(), lt.Nanosecond(), base)
+	return now.Sub(bt)
+}
+
+// shiftRequest is how a listener asked to be shifted, from the query string.
+// Exactly one of Timezone, Delay or At is needed, though Timezone can also be
+// given with At to say which zone a local time is in.
+type shiftRequest struct {
+	// Timezone is an IANA zone name or a fixed offset like +08:00.
+	Timezone string
+	// Ahead overrides the stream's aheadOfBase policy.
+	Ahead string
+	// Delay is a fixed duration behind live, like 3h30m.
+	Delay string
+	// At is an absolute point to start from, see parseListenerTime.
+	At string
+}
+
+func shiftRequestFromQuery(q url.Values) shiftRequest {
+	return shiftRequest{
+		Timezone: q.Get("tz"),
+		Ahead:    q.Get("ahead"),
+		Delay:    q.Get("delay"),
+		At:       q.Get("at"),
+	}
+}
+
+func (r shiftRequest) empty() bool {
+	return r.Timezone == "" && r.Delay == "" && r.At == ""
+}
+
+// key identifies equivalent requests, for de-duplicating session creation.
+func (r shiftRequest) key() string {
+	return strings.Join([]string{r.Timezone, r.Ahead, r.Delay, r.At}, "\x00")
+}
+
+// timeshift builds the timeshift for the request against a stream. now is used
+// to resolve At into a delay.
+func (r shiftRequest) timeshift(st configStream, now time.Time) (timeshift, error) {
+	if r.empty() {
+		return timeshift{}, errors.New("one of tz, delay or at must be given")
+	}
+	if r.Delay != "" && r.At != "" {
+		return timeshift{}, errors.New("only one of delay or at can be given")
+	}
+
+	switch {
+	case r.Delay != "":
+		d, err := time.ParseDuration(r.Delay)
+		if err != nil {
+			return timeshift{}, fmt.Errorf("parsing delay %s: %v", r.Delay, err)
+		}
+		if d < 0 {
+			return timeshift{}, fmt.Errorf("delay %s can't be negative", r.Delay)
+		}
+		return timeshift{fixed: true, delay: d}, nil
+	case r.At != "":
+		zone := r.Timezone
+		if zone == "" {
+			zone = st.BaseTimezone
+		}
+		loc, err := loadListenerLocation(zone)
+		if err != nil {
+			return timeshift{}, fmt.Errorf("finding timezone %s: %v", zone, err)
+		}
+		at, err := parseListenerTime(r.At, loc, now)
+		if err != nil {
+			return timeshift{}, err
+		}
+		if at.After(now) {
+			return timeshift{}, fmt.Errorf("at %s is in the future", r.At)
+		}
+		return timeshift{fixed: true, delay: now.Sub(at)}, nil
+	}
+
+	ahead := st.AheadOfBase
+	if r.Ahead != "" {
+		ahead = aheadPolicy(r.Ahead)
+	}
+	return newTimeshift(st.BaseTimezone, r.Timezone, st.DSTPolicy, ahead)
+}
+
+var fixedZoneRE = regexp.MustCompile(`^(?:UTC|GMT)?([+-])(\d{1,2})(?::?(\d{2}))?$`)
+
+// loadListenerLocation loads an IANA zone, or a fixed offset zone like
+// +08:00, -0530 or UTC+10. An unescaped + in a query string arrives as a
+// space, so a leading space is read as +.
+func loadListenerLocation(name string) (*time.Location, error) {
+	if strings.HasPrefix(name, " ") {
+		name = "+" + strings.TrimLeft(name, " ")
+	}
+	m := fixedZoneRE.FindStringSubmatch(name)
+	if m == nil {
+		return time.LoadLocation(name)
+	}
+	h, _ := strconv.Atoi(m[2])
+	var mins int
+	if m[3] != "" {
+		mins, _ = strconv.Atoi(m[3])
+	}
+	if h > 14 || mins > 59 {
+		return nil, fmt.Errorf("invalid offset %s", name)
+	}
+	secs := h*3600 + mins*60
+	if m[1] == "-" {
+		secs = -secs
+	}
+	return time.FixedZone(name, secs), nil
+}
+
+// parseListenerTime parses an absolute time given by a listener. It accepts
+// RFC3339, a local date and time ("2006-01-02 15:04" or with a T), or a local
+// time of day ("07:00", "yesterday 07:00"). Local times are in loc, and a bare
+// time of day means the most recent one at or before now.
+func parseListenerTime(v string, loc *time.Location, now time.Time) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	daysBack := 0
+	if rest, ok := strings.CutPrefix(v, "yesterday "); ok {
+		daysBack = 1
+		v = strings.TrimSpace(rest)
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		tod, err := time.Parse(layout, v)
+		if err != nil {
+			continue
+		}
+		ln := now.In(loc)
+		t := time.Date(ln.Year(), ln.Month(), ln.Day(), tod.Hour(), tod.Minute(), tod.Second(), 0, loc)
+		if daysBack == 0 && t.After(now) {
+			daysBack = 1
+		}
+		return t.AddDate(0, 0, -daysBack), nil
+	}
+	return time.Time{}, fmt.Errorf("can't parse time %q", v)
+}
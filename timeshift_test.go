@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeshiftOffset(t *testing.T) {
+	for _, tc := range []struct {
+		Name       string
+		Base, User string
+		At         time.Time
+		Want       time.Duration
+	}{
+		{
+			Name: "Sydney to Perth in summer",
+			Base: "Australia/Sydney",
+			User: "Australia/Perth",
+			At:   time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC),
+			Want: 3 * time.Hour,
+		},
+		{
+			Name: "Sydney to Perth in winter",
+			Base: "Australia/Sydney",
+			User: "Australia/Perth",
+			At:   time.Date(2026, 7, 15, 0, 0, 0, 0, time.UTC),
+			Want: 2 * time.Hour,
+		},
+		{
+			Name: "Sydney to Los Angeles in July",
+			Base: "Australia/Sydney",
+			User: "America/Los_Angeles",
+			At:   time.Date(2026, 7, 15, 0, 0, 0, 0, time.UTC),
+			Want: 17 * time.Hour,
+		},
+		{
+			Name: "Same zone",
+			Base: "Australia/Sydney",
+			User: "Australia/Sydney",
+			At:   time.Date(2026, 10, 4, 15, 30, 0, 0, time.UTC),
+			Want: 0,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			ts, err := newTimeshift(tc.Base, tc.User, dstContinuous, aheadLive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ts.Offset(tc.At); got != tc.Want {
+				t.Errorf("want offset %s, got %s", tc.Want, got)
+			}
+		})
+	}
+}
+
+func TestTimeshiftDSTPolicy(t *testing.T) {
+	// Sydney starts DST at 2am on 2026-10-04, Perth doesn't observe it. The
+	// offset changes once the Perth listener's clock reaches 2am.
+	before := time.Date(2026, 10, 3, 15, 0, 0, 0, time.UTC)
+	after := time.Date(2026, 10, 3, 19, 0, 0, 0, time.UTC)
+
+	cont, err := newTimeshift("Australia/Sydney", "Australia/Perth", dstContinuous, aheadLive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := cont.Offset(before)
+	if start != 2*time.Hour {
+		t.Fatalf("want 2h before the change, got %s", start)
+	}
+	if got, changed := cont.Next(start, after); changed || got != start {
+		t.Errorf("continuous should keep %s, got %s (changed %t)", start, got, changed)
+	}
+
+	wc, err := newTimeshift("Australia/Sydney", "Australia/Perth", dstWallclock, aheadLive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, changed := wc.Next(start, before); changed || got != start {
+		t.Errorf("wallclock should keep %s before the change, got %s", start, got)
+	}
+	if got, changed := wc.Next(start, after); !changed || got != 3*time.Hour {
+		t.Errorf("wallclock should move to 3h after the change, got %s (changed %t)", got, changed)
+	}
+}
+
+func TestTimeshiftAhead(t *testing.T) {
+	// Auckland is 2h ahead of Sydney in January
+	at := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+
+	live, err := newTimeshift("Australia/Sydney", "Pacific/Auckland", dstContinuous, aheadLive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := live.Offset(at); got != -2*time.Hour {
+		t.Errorf("live: want -2h, got %s", got)
+	}
+
+	pd, err := newTimeshift("Australia/Sydney", "Pacific/Auckland", dstContinuous, aheadPreviousDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pd.Offset(at); got != 22*time.Hour {
+		t.Errorf("previous day: want 22h, got %s", got)
+	}
+
+	// zones behind the station are unaffected
+	behind, err := newTimeshift("Australia/Sydney", "Australia/Perth", dstContinuous, aheadPreviousDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := behind.Offset(at); got != 3*time.Hour {
+		t.Errorf("behind: want 3h, got %s", got)
+	}
+}
+
+func TestShiftRequest(t *testing.T) {
+	st := configStream{ID: "s", BaseTimezone: "Australia/Sydney", DSTPolicy: dstContinuous, AheadOfBase: aheadLive}
+	// 2026-01-15 09:00 in Sydney (AEDT, +11)
+	now := time.Date(2026, 1, 14, 22, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		Name    string
+		Req     shiftRequest
+		Want    time.Duration
+		WantErr bool
+	}{
+		{Name: "IANA zone", Req: shiftRequest{Timezone: "Australia/Perth"}, Want: 3 * time.Hour},
+		{Name: "Fixed offset zone", Req: shiftRequest{Timezone: "+08:00"}, Want: 3 * time.Hour},
+		{Name: "Fixed offset zone, plus lost in query", Req: shiftRequest{Timezone: " 0800"}, Want: 3 * time.Hour},
+		{Name: "UTC prefixed offset", Req: shiftRequest{Timezone: "UTC-5"}, Want: 16 * time.Hour},
+		{Name: "Delay", Req: shiftRequest{Delay: "3h30m"}, Want: 3*time.Hour + 30*time.Minute},
+		{Name: "At RFC3339", Req: shiftRequest{At: "2026-01-14T20:00:00Z"}, Want: 2 * time.Hour},
+		{Name: "At local date time in base zone", Req: shiftRequest{At: "2026-01-15 07:00"}, Want: 2 * time.Hour},
+		{Name: "At time of day today", Req: shiftRequest{At: "07:00"}, Want: 2 * time.Hour},
+		{Name: "At time of day later means yesterday", Req: shiftRequest{At: "10:00"}, Want: 23 * time.Hour},
+		{Name: "At yesterday", Req: shiftRequest{At: "yesterday 07:00"}, Want: 26 * time.Hour},
+		{Name: "At in listener zone", Req: shiftRequest{Timezone: "Australia/Perth", At: "06:00"}, Want: 0},
+		{Name: "Nothing", Req: shiftRequest{}, WantErr: true},
+		{Name: "Delay and at", Req: shiftRequest{Delay: "1h", At: "07:00"}, WantErr: true},
+		{Name: "Negative delay", Req: shiftRequest{Delay: "-1h"}, WantErr: true},
+		{Name: "At in the future", Req: shiftRequest{At: "2026-01-15T00:00:00Z"}, WantErr: true},
+		{Name: "Bad zone", Req: shiftRequest{Timezone: "Nowhere/Special"}, WantErr: true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			ts, err := tc.Req.timeshift(st, now)
+			if tc.WantErr {
+				if err == nil {
+					t.Fatalf("want error, got offset %s", ts.Offset(now))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ts.Offset(now); got != tc.Want {
+				t.Errorf("want offset %s, got %s", tc.Want, got)
+			}
+			// fixed shifts never move
+			if tc.Req.Delay != "" || tc.Req.At != "" {
+				if _, changed := ts.Next(tc.Want, now.Add(180*24*time.Hour)); changed {
+					t.Error("fixed shift should not change")
+				}
+			}
+		})
+	}
+}
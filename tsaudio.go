@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Comcast/gots/v2/psi"
+)
+
+const (
+	contentTypeAAC  = "audio/aac"
+	contentTypeMPEG = "audio/mpeg"
+)
+
+// audioStreamContentTypes are the PMT stream types we can pass straight
+// through to a listener, and what they are.
+var audioStreamContentTypes = map[uint8]string{
+	0x03:                 contentTypeMPEG, // MPEG-1 audio, including MP3
+	0x04:                 contentTypeMPEG, // MPEG-2 audio
+	psi.PmtStreamTypeAac: contentTypeAAC,  // AAC in ADTS
+}
+
+// audioExtensions are the file extensions for each audio content type.
+var audioExtensions = map[string]string{
+	contentTypeAAC:  "aac",
+	contentTypeMPEG: "mp3",
+}
+
+// firstProgramPid returns the PMT PID of the lowest numbered program. HLS
+// segments only ever carry one.
+func firstProgramPid(pat psi.PAT) (int, error) {
+	pm := pat.ProgramMap()
+	if len(pm) == 0 {
+		return 0, errors.New("no programs in pat")
+	}
+	var pns []int
+	for pn := range pm {
+		pns = append(pns, pn)
+	}
+	return pm[slices.Min(pns)], nil
+}
+
+// selectAudioStream picks the audio elementary stream to play. If lang is set
+// and a stream is tagged with it that one is used, otherwise the first
+// supported audio stream is.
+func selectAudioStream(ess []psi.PmtElementaryStream, lang string) (psi.PmtElementaryStream, error) {
+	var first psi.PmtElementaryStream
+	for _, es := range ess {
+		if _, ok := audioStreamContentTypes[es.StreamType()]; !ok {
+			continue
+		}
+		if first == nil {
+			first = es
+		}
+		if lang != "" && strings.EqualFold(streamLanguage(es), lang) {
+			return es, nil
+		}
+	}
+	if first == nil {
+		var types []string
+		for _, es := range ess {
+			types = append(types, fmt.Sprintf("0x%02x", es.StreamType()))
+		}
+		return nil, fmt.Errorf("no supported audio stream, have stream types %s", strings.Join(types, ", "))
+	}
+	return first, nil
+}
+
+// streamLanguage returns the ISO 639 language an elementary stream is tagged
+// with, if any.
+func streamLanguage(es psi.PmtElementaryStream) string {
+	for _, d := range es.Descriptors() {
+		if d.IsIso639LanguageDescriptor() {
+			return d.DecodeIso639LanguageCode()
+		}
+	}
+	return ""
+}
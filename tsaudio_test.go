@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReadChunkAudioSelectsStream(t *testing.T) {
+	ctx := context.Background()
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eng := testADTSFrames(0x10, 3, 100)
+	fra := [][]byte{bytes.Repeat([]byte{0xaa}, 50), bytes.Repeat([]byte{0xbb}, 50)}
+	ts := buildTestTS([]testES{
+		{pid: 0x101, streamType: 0x0f, lang: "eng", pes: eng},
+		{pid: 0x102, streamType: 0x03, lang: "fra", pes: fra},
+		{pid: 0x103, streamType: 0x1b, pes: [][]byte{{0, 0, 0, 1}}}, // h264, ignored
+	}, map[int]byte{})
+
+	key := encodeObjectKey("s", time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC), 10, 1, 0, "chunk-1.ts")
+	if err := fs.PutObject(ctx, key, ts); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.LoadStream(ctx, "s"); err != nil {
+		t.Fatal(err)
+	}
+	rcs, err := idx.Chunks(ctx, "s", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		lang     string
+		wantType string
+		want     []byte
+	}{
+		{lang: "", wantType: contentTypeAAC, want: bytes.Join(eng, nil)},
+		{lang: "FRA", wantType: contentTypeMPEG, want: bytes.Join(fra, nil)},
+		{lang: "deu", wantType: contentTypeAAC, want: bytes.Join(eng, nil)},
+	} {
+		ca, err := readChunkAudio(ctx, fs, rcs[0], tc.lang)
+		if err != nil {
+			t.Fatalf("lang %q: %v", tc.lang, err)
+		}
+		if ca.contentType != tc.wantType {
+			t.Errorf("lang %q: want content type %s, got %s", tc.lang, tc.wantType, ca.contentType)
+		}
+		if !bytes.Equal(ca.frames, tc.want) {
+			t.Errorf("lang %q: got %d bytes of audio, want %d", tc.lang, len(ca.frames), len(tc.want))
+		}
+	}
+}
+
+func TestReadChunkAudioNoSupportedStream(t *testing.T) {
+	ctx := context.Background()
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := buildTestTS([]testES{
+		{pid: 0x101, streamType: 0x81, pes: [][]byte{{1, 2, 3}}}, // AC-3
+	}, map[int]byte{})
+	key := encodeObjectKey("s", time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC), 10, 1, 0, "chunk-1.ts")
+	if err := fs.PutObject(ctx, key, ts); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.LoadStream(ctx, "s"); err != nil {
+		t.Fatal(err)
+	}
+	rcs, err := idx.Chunks(ctx, "s", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readChunkAudio(ctx, fs, rcs[0], ""); err == nil {
+		t.Error("want error for a segment with no supported audio")
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	gots "github.com/Comcast/gots/v2"
+	"github.com/Comcast/gots/v2/packet"
+	"github.com/Comcast/gots/v2/psi"
+)
+
+// chunkAudio is the audio demuxed from one chunk. For AAC, frames is only
+// whole ADTS frames. A frame split over a chunk boundary is left as the tail of
+// one chunk and the head of the next, see audioJoiner.
+type chunkAudio struct {
+	contentType string
+	frames      []byte
+	head, tail  []byte
+}
+
+// tsDemuxer reads packets from an MPEG-TS stream. Reads are buffered, so short
+// reads from the underlying reader are fine, and it resyncs on the sync byte if
+// it finds junk between packets.
+type tsDemuxer struct {
+	r   *bufio.Reader
+	pkt packet.Packet
+	cc  map[int]int
+	// lost is set while skipping junk looking for a packet
+	lost bool
+}
+
+func newTSDemuxer(r io.Reader) *tsDemuxer {
+	return &tsDemuxer{
+		r:  bufio.NewReaderSize(r, 64*packet.PacketSize),
+		cc: make(map[int]int),
+	}
+}
+
+// next returns the next packet, and whether packets were lost or the stream
+// flagged a discontinuity on its PID since the last one. It returns io.EOF at
+// the end of the stream, dropping any trailing partial packet.
+func (d *tsDemuxer) next() (pkt *packet.Packet, discontinuity bool, err error) {
+	for {
+		if err := d.sync(); err != nil {
+			return nil, false, err
+		}
+		if _, err := io.ReadFull(d.r, d.pkt[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, false, io.EOF
+			}
+			return nil, false, err
+		}
+		if d.pkt.TransportErrorIndicator() {
+			tsDemuxErrorCount.WithLabelValues("transport").Inc()
+			continue
+		}
+		disc, dup := d.continuity(&d.pkt)
+		if dup {
+			continue
+		}
+		return &d.pkt, disc, nil
+	}
+}
+
+// sync skips to the next sync byte. When finding sync again after junk, it has
+// to be followed by another one a packet later, so a stray 0x47 in the junk
+// isn't taken as a packet start.
+func (d *tsDemuxer) sync() error {
+	for {
+		b, err := d.r.Peek(packet.PacketSize + 1)
+		if len(b) == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return err
+		}
+		if b[0] == packet.SyncByte && (!d.lost || len(b) <= packet.PacketSize || b[packet.PacketSize] == packet.SyncByte) {
+			if d.lost {
+				tsDemuxErrorCount.WithLabelValues("resync").Inc()
+				d.lost = false
+			}
+			return nil
+		}
+		d.lost = true
+		n := bytes.IndexByte(b[1:], packet.SyncByte)
+		if n < 0 {
+			n = len(b) - 1
+		}
+		if _, err := d.r.Discard(n + 1); err != nil {
+			return err
+		}
+	}
+}
+
+// continuity checks pkt's continuity counter against the last on its PID. A
+// repeated counter is a duplicate packet, which is allowed once and should be
+// dropped.
+func (d *tsDemuxer) continuity(pkt *packet.Packet) (discontinuity, duplicate bool) {
+	pid := pkt.PID()
+	if pid == packet.NullPacketPid {
+		return false, false
+	}
+	cc := pkt.ContinuityCounter()
+	last, seen := d.cc[pid]
+	d.cc[pid] = cc
+	if discontinuityIndicator(pkt) {
+		return true, false
+	}
+	if !seen || !pkt.HasPayload() {
+		// the counter only increments on packets with a payload
+		return false, false
+	}
+	switch cc {
+	case (last + 1) & 0x0f:
+		return false, false
+	case last:
+		return false, true
+	}
+	tsDemuxErrorCount.WithLabelValues("continuity").Inc()
+	return true, false
+}
+
+// discontinuityIndicator reports if the adaptation field flags a
+// discontinuity, e.g. the encoder was restarted.
+func discontinuityIndicator(pkt *packet.Packet) bool {
+	return pkt.HasAdaptationField() && pkt[4] > 0 && pkt[5]&0x80 != 0
+}
+
+// demuxTSAudio extracts the audio elementary stream for lang (see
+// selectAudioStream) from a TS segment. AAC is framed with an adtsFramer, so
+// lost packets cost the frames they touched rather than corrupting the
+// output. Other codecs are passed through as-is.
+func demuxTSAudio(r io.Reader, lang string) (chunkAudio, error) {
+	d := newTSDemuxer(r)
+
+	var (
+		pmtPid   = -1
+		audioPid = -1
+		pmtAcc   packet.Accumulator
+		ca       chunkAudio
+		framer   *adtsFramer
+		pes      []byte
+		inPES    bool
+	)
+	for {
+		pkt, disc, err := d.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return chunkAudio{}, err
+		}
+		pid := pkt.PID()
+
+		switch {
+		case pid == 0 && pmtPid == -1:
+			if !pkt.PayloadUnitStartIndicator() {
+				continue
+			}
+			pl, err := pkt.Payload()
+			if err != nil {
+				return chunkAudio{}, fmt.Errorf("getting pat payload: %w", err)
+			}
+			pat, err := psi.NewPAT(pl)
+			if err != nil {
+				return chunkAudio{}, fmt.Errorf("getting pat: %w", err)
+			}
+			if pmtPid, err = firstProgramPid(pat); err != nil {
+				return chunkAudio{}, err
+			}
+			pmtAcc = packet.NewAccumulator(psi.PmtAccumulatorDoneFunc)
+
+		case pid == pmtPid && audioPid == -1:
+			if _, err := pmtAcc.WritePacket(pkt); !errors.Is(err, gots.ErrAccumulatorDone) {
+				if err != nil {
+					// a lost packet or junk, start again from the next one
+					pmtAcc = packet.NewAccumulator(psi.PmtAccumulatorDoneFunc)
+				}
+				continue
+			}
+			pmt, err := psi.NewPMT(pmtAcc.Bytes())
+			if err != nil {
+				return chunkAudio{}, fmt.Errorf("getting pmt: %w", err)
+			}
+			es, err := selectAudioStream(pmt.ElementaryStreams(), lang)
+			if err != nil {
+				return chunkAudio{}, err
+			}
+			audioPid = es.ElementaryPid()
+			ca.contentType = audioStreamContentTypes[es.StreamType()]
+			if ca.contentType == contentTypeAAC {
+				framer = &adtsFramer{}
+			}
+
+		case pid == audioPid:
+			if disc {
+				inPES = false
+				if framer != nil {
+					framer.Discontinuity()
+				}
+			}
+			if !pkt.HasPayload() {
+				continue
+			}
+			pl, err := pkt.Payload()
+			if err != nil {
+				continue
+			}
+			if pkt.PayloadUnitStartIndicator() {
+				data, ok := pesData(pl)
+				if !ok {
+					tsDemuxErrorCount.WithLabelValues("pes").Inc()
+					inPES = false
+					if framer != nil {
+						framer.Discontinuity()
+					}
+					continue
+				}
+				inPES, pl = true, data
+			} else if !inPES && (disc || framer == nil || framer.started) {
+				// not part of a PES packet we can use. The rest of one started
+				// in the previous chunk is still passed on, so the framer can
+				// keep it as the head.
+				continue
+			}
+			if framer != nil {
+				framer.Write(pl)
+			} else {
+				pes = append(pes, pl...)
+			}
+		}
+	}
+	if pmtPid == -1 {
+		return chunkAudio{}, errors.New("no pat in segment")
+	}
+	if audioPid == -1 {
+		return chunkAudio{}, errors.New("no pmt in segment")
+	}
+	if framer != nil {
+		ca.frames, ca.head, ca.tail = framer.Close()
+	} else {
+		ca.frames = pes
+	}
+	return ca, nil
+}
+
+// pesData returns the elementary stream data in the first packet of a PES
+// packet.
+func pesData(pl []byte) ([]byte, bool) {
+	if len(pl) < 9 || pl[0] != 0 || pl[1] != 0 || pl[2] != 1 {
+		return nil, false
+	}
+	start := 9 + int(pl[8])
+	if start > len(pl) {
+		return nil, false
+	}
+	return pl[start:], true
+}
+
+// adtsFramer splits an ADTS stream into whole frames. A frame is only taken
+// once the next one's sync word is seen where its length says it should be,
+// so a false sync in the payload doesn't throw the framing off. Bytes before
+// the first frame are kept as the head, in case they finish a frame from the
+// previous chunk.
+type adtsFramer struct {
+	pending []byte
+	frames  []byte
+	head    []byte
+	// started is set once the head is settled, either by finding the first
+	// frame or by losing data before it.
+	started bool
+}
+
+// Write adds more of the stream.
+func (f *adtsFramer) Write(p []byte) {
+	f.pending = append(f.pending, p...)
+	f.split(false)
+}
+
+// Discontinuity drops any partial frame, as the data after it doesn't follow
+// on.
+func (f *adtsFramer) Discontinuity() {
+	f.pending = nil
+	f.started = true
+	f.head = nil
+}
+
+// Close returns the frames, along with any leading and trailing partial frame.
+func (f *adtsFramer) Close() (frames, head, tail []byte) {
+	f.split(true)
+	if len(f.pending) > 0 && f.pending[0] == 0xff {
+		tail = f.pending
+	}
+	if !f.started {
+		// never found a frame, so can't tell what this is
+		f.head = nil
+	}
+	return f.frames, f.head, tail
+}
+
+func (f *adtsFramer) split(final bool) {
+	for len(f.pending) > 0 {
+		n, ok := adtsFrameLength(f.pending)
+		if !ok {
+			if len(f.pending) < adtsHeaderLen && (adtsSync(f.pending) || len(f.pending) == 1 && f.pending[0] == 0xff) {
+				// could be the start of a header, wait for more
+				return
+			}
+			f.skip(1)
+			continue
+		}
+		if len(f.pending) < n {
+			return
+		}
+		if len(f.pending) < n+2 && !final {
+			// wait until we can check the next sync word
+			return
+		}
+		if len(f.pending) >= n+2 && !adtsSync(f.pending[n:]) {
+			f.skip(1)
+			continue
+		}
+		f.frames = append(f.frames, f.pending[:n]...)
+		f.pending = f.pending[n:]
+		f.started = true
+	}
+}
+
+// skip drops n bytes from the front of pending. They are part of the head if
+// no frame has been found yet, otherwise junk.
+func (f *adtsFramer) skip(n int) {
+	if !f.started {
+		f.head = append(f.head, f.pending[:n]...)
+	}
+	f.pending = f.pending[n:]
+}
+
+const adtsHeaderLen = 7
+
+func adtsSync(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0xff && b[1]&0xf6 == 0xf0
+}
+
+// adtsFrameLength returns the length of the frame at the start of b, if it
+// starts with a valid header.
+func adtsFrameLength(b []byte) (int, bool) {
+	if len(b) < adtsHeaderLen || !adtsSync(b) {
+		return 0, false
+	}
+	if sfi := b[2] >> 2 & 0x0f; sfi > 12 {
+		return 0, false
+	}
+	n := int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5])>>5
+	hl := adtsHeaderLen
+	if b[1]&0x01 == 0 {
+		hl += 2 // crc
+	}
+	if n < hl {
+		return 0, false
+	}
+	return n, true
+}
+
+// audioJoiner writes each chunk's audio in turn, rejoining frames split over
+// chunk boundaries. This happens on a per-listener basis, as the chunk audio
+// is shared.
+type audioJoiner struct {
+	tail []byte
+	next int
+}
+
+// Write writes a's audio, first completing the frame cut off at the end of the
+// previous chunk if c follows on from it, and isn't after a discontinuity.
+func (j *audioJoiner) Write(w io.Writer, c recordedChunk, a chunkAudio) error {
+	if j.tail != nil && c.Sequence == j.next && !c.Discontinuity {
+		f := append(append([]byte{}, j.tail...), a.head...)
+		if n, ok := adtsFrameLength(f); ok && n == len(f) {
+			if _, err := w.Write(f); err != nil {
+				return err
+			}
+		}
+	}
+	j.tail, j.next = a.tail, c.Sequence+1
+	_, err := w.Write(a.frames)
+	return err
+}
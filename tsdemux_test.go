@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/iotest"
+)
+
+var updateTestdata = flag.Bool("update-testdata", false, "regenerate the synthetic TS segments in testdata")
+
+// tsTestFrames are the frames carried by the segments in testdata.
+var tsTestFrames = testADTSFrames(1, 10, 100)
+
+// tsTestSegments builds the segments in testdata, from tsTestFrames two to a
+// PES packet.
+func tsTestSegments() map[string][]byte {
+	f := tsTestFrames
+	pairs := func(fs [][]byte) [][]byte {
+		var pes [][]byte
+		for i := 0; i < len(fs); i += 2 {
+			pes = append(pes, slices.Concat(fs[i:min(i+2, len(fs))]...))
+		}
+		return pes
+	}
+	packets := func(b []byte) [][]byte {
+		var ps [][]byte
+		for len(b) > 0 {
+			n := min(len(b), tsPktSize)
+			ps = append(ps, b[:n])
+			b = b[n:]
+		}
+		return ps
+	}
+	aac := func(rest []byte, pes [][]byte) []testES {
+		return []testES{{pid: 0x101, streamType: 0x0f, rest: rest, pes: pes}}
+	}
+
+	segs := map[string][]byte{}
+
+	// frame 5 is split between two segments
+	cc := map[int]byte{}
+	segs["split_01.ts"] = buildTestTS(aac(nil, append(pairs(f[:4]), f[4][:50])), cc)
+	segs["split_02.ts"] = buildTestTS(aac(f[4][50:], pairs(f[5:])), cc)
+
+	// PAT, PMT, then two packets per PES. Drop the second half of the
+	// second PES, which is most of frame 4.
+	ps := packets(buildTestTS(aac(nil, pairs(f)), map[int]byte{}))
+	segs["lost_packet.ts"] = slices.Concat(slices.Delete(slices.Clone(ps), 5, 6)...)
+
+	// the end of the first PES sent twice
+	segs["duplicate.ts"] = slices.Concat(slices.Insert(slices.Clone(ps), 3, ps[3])...)
+
+	// junk between packets, including a sync byte, and a truncated packet on
+	// the end
+	junk := slices.Clone(ps)
+	junk = slices.Insert(junk, 4, []byte{0x00, 0x47, 0x12, 0x47, 0xff})
+	junk = append(junk, ps[2][:100])
+	segs["junk.ts"] = slices.Concat(junk...)
+
+	return segs
+}
+
+func readTSTestdata(t *testing.T) map[string][]byte {
+	t.Helper()
+	segs := tsTestSegments()
+	for name, b := range segs {
+		path := filepath.Join("testdata", name)
+		if *updateTestdata {
+			if err := os.WriteFile(path, b, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v, regenerate with -update-testdata", err)
+		}
+		segs[name] = got
+	}
+	return segs
+}
+
+func TestDemuxTSAudio(t *testing.T) {
+	segs := readTSTestdata(t)
+	all := slices.Concat(tsTestFrames...)
+
+	for _, tc := range []struct {
+		name string
+		// short reads a byte at a time
+		short bool
+		want  []byte
+	}{
+		{name: "duplicate.ts", want: all},
+		{name: "junk.ts", want: all},
+		{name: "junk.ts", short: true, want: all},
+		{name: "lost_packet.ts", want: slices.Concat(slices.Delete(slices.Clone(tsTestFrames), 3, 4)...)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(segs[tc.name])
+			if tc.short {
+				r = iotest.OneByteReader(r)
+			}
+			ca, err := demuxTSAudio(r, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ca.contentType != contentTypeAAC {
+				t.Errorf("want aac, got %s", ca.contentType)
+			}
+			if !bytes.Equal(ca.frames, tc.want) {
+				t.Errorf("got %d bytes of frames, want %d", len(ca.frames), len(tc.want))
+			}
+		})
+	}
+}
+
+func TestDemuxTSAudioSplitFrame(t *testing.T) {
+	segs := readTSTestdata(t)
+
+	var audio []chunkAudio
+	for _, name := range []string{"split_01.ts", "split_02.ts"} {
+		ca, err := demuxTSAudio(bytes.NewReader(segs[name]), "")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		audio = append(audio, ca)
+	}
+	if !bytes.Equal(audio[0].frames, slices.Concat(tsTestFrames[:4]...)) {
+		t.Errorf("first segment should only have whole frames 1-4, got %d bytes", len(audio[0].frames))
+	}
+	if len(audio[0].tail) != 50 || len(audio[1].head) != len(tsTestFrames[4])-50 {
+		t.Errorf("want frame 5 split 50/%d, got %d/%d", len(tsTestFrames[4])-50, len(audio[0].tail), len(audio[1].head))
+	}
+
+	var buf bytes.Buffer
+	var j audioJoiner
+	for i, ca := range audio {
+		if err := j.Write(&buf, recordedChunk{Sequence: i + 1}, ca); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), slices.Concat(tsTestFrames...)) {
+		t.Errorf("joined segments should have every frame, got %d bytes", buf.Len())
+	}
+
+	// if the chunks don't follow on, the split frame is dropped
+	buf.Reset()
+	j = audioJoiner{}
+	for i, ca := range audio {
+		if err := j.Write(&buf, recordedChunk{Sequence: i * 2}, ca); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := slices.Concat(slices.Delete(slices.Clone(tsTestFrames), 4, 5)...)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("want frame 5 dropped, got %d bytes", buf.Len())
+	}
+}
+
+func TestADTSFramerFalseSync(t *testing.T) {
+	// a payload that looks like it has a frame header in it
+	fake := testADTSFrame(0, 40)
+	copy(fake[20:], testADTSFrame(0, 2)[:7])
+	frames := [][]byte{testADTSFrame(1, 30), fake, testADTSFrame(2, 30)}
+	stream := slices.Concat(frames...)
+
+	var f adtsFramer
+	// junk on the front, then the stream in dribs and drabs
+	f.Write([]byte{0x01, 0xff})
+	for b := range slices.Chunk(stream, 5) {
+		f.Write(b)
+	}
+	got, head, tail := f.Close()
+	if !bytes.Equal(got, stream) {
+		t.Errorf("want all frames, got %x", got)
+	}
+	if !bytes.Equal(head, []byte{0x01, 0xff}) || tail != nil {
+		t.Errorf("want junk as head and no tail, got %x %x", head, tail)
+	}
+}
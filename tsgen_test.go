@@ -0,0 +1,180 @@
+package main
+
+import "bytes"
+
+// Helpers to build small synthetic MPEG-TS segments for tests, so we don't
+// need to commit recordings of real stations.
+
+const (
+	testPMTPid = 0x1000
+	tsPktSize  = 188
+)
+
+// testES is an elementary stream in a generated segment.
+type testES struct {
+	pid        int
+	streamType uint8
+	lang       string
+	// rest is the end of a PES packet started in the previous segment, sent
+	// before any new ones.
+	rest []byte
+	// pes are the PES packet payloads, each sent as its own PES packet.
+	pes [][]byte
+}
+
+// buildTestTS returns a segment with a PAT, a PMT listing streams, then each
+// stream's frames interleaved. cc holds the continuity counter per PID, and is
+// updated so segments can follow on from each other.
+func buildTestTS(streams []testES, cc map[int]byte) []byte {
+	var out bytes.Buffer
+	writeSection := func(pid int, section []byte) {
+		out.Write(tsPacket(pid, true, cc, append([]byte{0}, section...)))
+	}
+
+	writeSection(0, patSection(testPMTPid))
+	writeSection(testPMTPid, pmtSection(streams))
+
+	writeData := func(pid int, pusi bool, data []byte) {
+		for len(data) > 0 {
+			n := min(len(data), tsPktSize-4)
+			out.Write(tsPacket(pid, pusi, cc, data[:n]))
+			data = data[n:]
+			pusi = false
+		}
+	}
+	for _, es := range streams {
+		writeData(es.pid, false, es.rest)
+	}
+	for i := 0; ; i++ {
+		var wrote bool
+		for _, es := range streams {
+			if i >= len(es.pes) {
+				continue
+			}
+			wrote = true
+			writeData(es.pid, true, pesPacket(es.pes[i], uint64(i)*1920))
+		}
+		if !wrote {
+			break
+		}
+	}
+	return out.Bytes()
+}
+
+// tsPacket wraps up to 184 bytes of payload, padding short ones with an
+// adaptation field.
+func tsPacket(pid int, pusi bool, cc map[int]byte, payload []byte) []byte {
+	if len(payload) > tsPktSize-4 {
+		panic("payload too big for a packet")
+	}
+	pkt := make([]byte, 4, tsPktSize)
+	pkt[0] = 0x47
+	pkt[1] = byte(pid>>8) & 0x1f
+	if pusi {
+		pkt[1] |= 0x40
+	}
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | cc[pid]&0x0f
+	cc[pid] = (cc[pid] + 1) & 0x0f
+
+	if stuff := tsPktSize - 4 - len(payload); stuff > 0 {
+		pkt[3] |= 0x20
+		pkt = append(pkt, byte(stuff-1))
+		if stuff > 1 {
+			pkt = append(pkt, 0x00)
+			for range stuff - 2 {
+				pkt = append(pkt, 0xff)
+			}
+		}
+	}
+	return append(pkt, payload...)
+}
+
+func patSection(pmtPid int) []byte {
+	body := []byte{
+		0x00, 0x01, // transport stream id
+		0xc1, 0x00, 0x00, // version, section numbers
+		0x00, 0x01, // program 1
+		0xe0 | byte(pmtPid>>8), byte(pmtPid),
+	}
+	return psiSection(0x00, body)
+}
+
+func pmtSection(streams []testES) []byte {
+	body := []byte{
+		0x00, 0x01, // program 1
+		0xc1, 0x00, 0x00, // version, section numbers
+		0xe0 | byte(streams[0].pid>>8), byte(streams[0].pid), // PCR pid
+		0xf0, 0x00, // no program info
+	}
+	for _, es := range streams {
+		var desc []byte
+		if es.lang != "" {
+			desc = append([]byte{0x0a, 4}, es.lang...)
+			desc = append(desc, 0)
+		}
+		body = append(body, es.streamType, 0xe0|byte(es.pid>>8), byte(es.pid), 0xf0|byte(len(desc)>>8), byte(len(desc)))
+		body = append(body, desc...)
+	}
+	return psiSection(0x02, body)
+}
+
+func psiSection(tableID byte, body []byte) []byte {
+	length := len(body) + 4 // crc
+	s := append([]byte{tableID, 0xb0 | byte(length>>8), byte(length)}, body...)
+	crc := mpegCRC32(s)
+	return append(s, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func mpegCRC32(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc ^= uint32(v) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// pesPacket wraps an access unit in an audio PES packet with a PTS.
+func pesPacket(data []byte, pts uint64) []byte {
+	l := 3 + 5 + len(data)
+	p := []byte{0x00, 0x00, 0x01, 0xc0, byte(l >> 8), byte(l), 0x80, 0x80, 5}
+	p = append(p,
+		0x21|byte(pts>>29)&0x0e,
+		byte(pts>>22),
+		byte(pts>>14)|1,
+		byte(pts>>7),
+		byte(pts<<1)|1,
+	)
+	return append(p, data...)
+}
+
+// testADTSFrame is an AAC-LC stereo 44.1kHz ADTS frame with a payload of n
+// bytes of b.
+func testADTSFrame(b byte, n int) []byte {
+	flen := 7 + n
+	f := []byte{
+		0xff, 0xf1,
+		1<<6 | 4<<2 | 2>>2,
+		(2&3)<<6 | byte(flen>>11),
+		byte(flen >> 3),
+		byte(flen&7)<<5 | 0x1f,
+		0xfc,
+	}
+	return append(f, bytes.Repeat([]byte{b}, n)...)
+}
+
+// testADTSFrames returns n frames, each filled with its own index.
+func testADTSFrames(start, n, size int) [][]byte {
+	var fs [][]byte
+	for i := range n {
+		fs = append(fs, testADTSFrame(byte(start+i), size))
+	}
+	return fs
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etherlabsio/go-m3u8/m3u8"
+)
+
+const (
+	variantSelectMaxBandwidth = "maxBandwidth"
+	variantSelectMinBandwidth = "minBandwidth"
+)
+
+// variantConfig picks the variant of a master playlist source that is
+// recorded. The filters narrow down the variants, then Select picks between
+// those left.
+type variantConfig struct {
+	// Select is maxBandwidth (default) or minBandwidth.
+	Select string `yaml:"select"`
+	// Codecs keeps variants with this codec in their CODECS, e.g. mp4a.40.2,
+	// or mp4a.40 for any AAC.
+	Codecs string `yaml:"codecs"`
+	// URI keeps variants whose URI matches this regular expression.
+	URI string `yaml:"uri"`
+	// AudioGroup keeps variants using the EXT-X-MEDIA audio group with this
+	// id, and Language those with an audio rendition in this language. If
+	// the rendition has its own playlist, that is recorded.
+	AudioGroup string `yaml:"audioGroup"`
+	Language   string `yaml:"language"`
+
+	uri *regexp.Regexp
+}
+
+// sourceVariant is a variant in a source's master playlist.
+type sourceVariant struct {
+	*m3u8.PlaylistItem
+	// Audio is the audio rendition it plays, nil if the audio is in the
+	// variant's own playlist.
+	Audio *m3u8.MediaItem
+}
+
+// PlaylistURI is the media playlist recorded for the variant.
+func (v sourceVariant) PlaylistURI() string {
+	if v.Audio != nil {
+		return *v.Audio.URI
+	}
+	return v.URI
+}
+
+// String describes the variant, for logs and to recognise it when the master
+// playlist is fetched again. URIs are left out, as they can carry tokens that
+// change.
+func (v sourceVariant) String() string {
+	var codecs, group, lang string
+	if v.Codecs != nil {
+		codecs = *v.Codecs
+	}
+	if v.PlaylistItem.Audio != nil {
+		group = *v.PlaylistItem.Audio
+	}
+	if v.Audio != nil && v.Audio.Language != nil {
+		lang = *v.Audio.Language
+	}
+	return fmt.Sprintf("bandwidth=%d codecs=%q audio=%q language=%q", v.Bandwidth, codecs, group, lang)
+}
+
+// match returns the variants in a master playlist that pass the filters, in
+// the order they're listed.
+func (c variantConfig) match(pl *m3u8.Playlist) []sourceVariant {
+	var out []sourceVariant
+	for _, it := range pl.Items {
+		pi, ok := it.(*m3u8.PlaylistItem)
+		if !ok || pi.IFrame {
+			continue
+		}
+		v := sourceVariant{PlaylistItem: pi}
+		if c.Codecs != "" && !hasCodec(pi.Codecs, c.Codecs) {
+			continue
+		}
+		if c.uri != nil && !c.uri.MatchString(pi.URI) {
+			continue
+		}
+		if pi.Audio != nil {
+			a, ok := c.audioRendition(pl, *pi.Audio)
+			if !ok {
+				continue
+			}
+			if a != nil && a.URI != nil {
+				v.Audio = a
+			}
+		} else if c.AudioGroup != "" || c.Language != "" {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// audioRendition returns the rendition of an audio group to play: one in the
+// configured language if set, otherwise the default or first, or nil if the
+// group has none. ok is false if the group doesn't pass the filters.
+func (c variantConfig) audioRendition(pl *m3u8.Playlist, group string) (*m3u8.MediaItem, bool) {
+	if c.AudioGroup != "" && group != c.AudioGroup {
+		return nil, false
+	}
+	var pick *m3u8.MediaItem
+	for _, it := range pl.Items {
+		mi, ok := it.(*m3u8.MediaItem)
+		if !ok || mi.Type != "AUDIO" || mi.GroupID != group {
+			continue
+		}
+		if c.Language != "" {
+			if mi.Language != nil && languageMatches(*mi.Language, c.Language) {
+				return mi, true
+			}
+			continue
+		}
+		if pick == nil || (mi.Default != nil && *mi.Default && (pick.Default == nil || !*pick.Default)) {
+			pick = mi
+		}
+	}
+	// a group without renditions leaves the audio in the variant
+	return pick, pick != nil || c.Language == ""
+}
+
+// pick returns the variant to record out of those matched.
+func (c variantConfig) pick(vs []sourceVariant) (sourceVariant, bool) {
+	if len(vs) == 0 {
+		return sourceVariant{}, false
+	}
+	best := vs[0]
+	for _, v := range vs[1:] {
+		if c.Select == variantSelectMinBandwidth && v.Bandwidth < best.Bandwidth ||
+			c.Select != variantSelectMinBandwidth && v.Bandwidth > best.Bandwidth {
+			best = v
+		}
+	}
+	return best, true
+}
+
+// hasCodec reports if a CODECS attribute lists codec, or a more specific
+// version of it.
+func hasCodec(codecs *string, codec string) bool {
+	if codecs == nil {
+		return false
+	}
+	for _, c := range strings.Split(*codecs, ",") {
+		c = strings.TrimSpace(c)
+		if strings.EqualFold(c, codec) || len(c) > len(codec) && strings.EqualFold(c[:len(codec)+1], codec+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// languageMatches reports if an EXT-X-MEDIA LANGUAGE is want, ignoring case
+// and any region, so en matches en-AU.
+func languageMatches(lang, want string) bool {
+	if strings.EqualFold(lang, want) {
+		return true
+	}
+	base, _, _ := strings.Cut(lang, "-")
+	return strings.EqualFold(base, want)
+}
+
+// streamVariant is one variant of a master playlist source, recorded as a
+// sub-stream of the stream.
+type streamVariant struct {
+	// ID is the sub-stream it's recorded as, stream/name.
+	ID string
+	// Name identifies the variant within the stream. It's the bandwidth, as
+	// that's what players pick variants by, with -2, -3 and so on after it
+	// for more variants of the same bandwidth, in the order the source lists
+	// them.
+	Name      string
+	Bandwidth int
+	// Codecs is the source's CODECS attribute, empty if unknown.
+	Codecs string
+}
+
+// newStreamVariant returns the nth (from 0) of the source's variants with the
+// given bandwidth.
+func newStreamVariant(streamID string, bandwidth, n int, codecs string) streamVariant {
+	name := strconv.Itoa(bandwidth)
+	if n > 0 {
+		name += "-" + strconv.Itoa(n+1)
+	}
+	return streamVariant{ID: streamID + "/" + name, Name: name, Bandwidth: bandwidth, Codecs: codecs}
+}
+
+// storedVariants returns the variants of a stream from the ids of its stored
+// sub-streams. Codecs aren't stored, so are unknown until the source is
+// fetched again.
+func storedVariants(streamID string, ids []string) []streamVariant {
+	var out []streamVariant
+	for _, id := range ids {
+		bws, ns, dup := strings.Cut(strings.TrimPrefix(id, streamID+"/"), "-")
+		bw, err := strconv.Atoi(bws)
+		if err != nil || bw <= 0 {
+			continue
+		}
+		var n int
+		if dup {
+			if n, err = strconv.Atoi(ns); err != nil || n < 2 {
+				continue
+			}
+			n--
+		}
+		out = append(out, newStreamVariant(streamID, bw, n, ""))
+	}
+	return out
+}
+
+// findVariant returns the variant with the given name.
+func findVariant(vs []streamVariant, name string) (streamVariant, bool) {
+	for _, v := range vs {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return streamVariant{}, false
+}
+
+// serveMasterPlaylist lists a session's variants, each linking to the
+// session's playlist for that variant.
+func (p *playlist) serveMasterPlaylist(w http.ResponseWriter, sid string, vs []streamVariant) {
+	pl := m3u8.Playlist{
+		Master:  new(true),
+		Version: new(4),
+	}
+	for _, v := range vs {
+		item := &m3u8.PlaylistItem{
+			Bandwidth: v.Bandwidth,
+			URI:       "/m3u8?" + url.Values{"sid": {sid}, "variant": {v.Name}}.Encode(),
+		}
+		if v.Codecs != "" {
+			item.Codecs = new(v.Codecs)
+		}
+		pl.AppendItem(item)
+	}
+
+	w.Header().Set("content-type", "application/x-mpegURL")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+
+	fmt.Fprint(w, pl.String())
+}
+
+// variantWindow lines the chunks of variant v up with the window of the
+// stream's primary variant, matching them by when they start. It returns the
+// part of the window the variant has, and the variant's chunks for it. The
+// window is cut at a chunk the variant is missing, so the playlist's
+// sequences stay the same across variants.
+func (p *playlist) variantWindow(v streamVariant, window []recordedChunk) (primary, chunks []recordedChunk) {
+	for i, rc := range window {
+		tolerance := time.Duration(rc.Duration * float64(time.Second) / 2)
+		vc, ok := p.indexer.ChunkAt(v.ID, rc.FetchedAt, tolerance)
+		if !ok {
+			if len(chunks) > 0 {
+				break
+			}
+			continue
+		}
+		if len(chunks) == 0 {
+			primary = window[i:]
+		}
+		chunks = append(chunks, vc)
+	}
+	return primary[:len(chunks)], chunks
+}
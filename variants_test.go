@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etherlabsio/go-m3u8/m3u8"
+	"github.com/sirupsen/logrus"
+)
+
+func TestVariantPlaylists(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	idx := newChunkIndex()
+	hi, lo := newStreamVariant("s", 128000, 0, "mp4a.40.2"), newStreamVariant("s", 48000, 0, "mp4a.40.5")
+	for i := range 60 {
+		at := now.Add(-10 * time.Minute).Add(time.Duration(i) * 10 * time.Second)
+		// the variants were recorded with their own sequences, and a little
+		// apart.
+		idx.Append(hi.ID, recordedChunk{Sequence: i + 1, ChunkID: fmt.Sprintf("hi-%d.ts", i+1), Duration: 10, FetchedAt: at})
+		idx.Append(lo.ID, recordedChunk{Sequence: i + 101, ChunkID: fmt.Sprintf("lo-%d.ts", i+1), Duration: 10, FetchedAt: at.Add(300 * time.Millisecond)})
+	}
+	idx.SetVariants("s", []streamVariant{lo, hi})
+
+	streams := []configStream{{ID: "s", BaseTimezone: "UTC", Retention: retentionConfig{MaxAge: time.Hour}}}
+	sessions := newHLSSessions()
+	pl := newPlaylist(logrus.New(), streams, idx, nil, sessions)
+	sid, err := sessions.Create(ctx, sessionData{StreamID: "s", Delay: "9m", Offset: 9 * time.Minute, LatestSequence: 10, IntroducedAt: now.Add(-5 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(q url.Values) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		pl.ServePlaylist(rec, httptest.NewRequest("GET", "/m3u8?"+q.Encode(), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+
+	master, err := m3u8.Read(strings.NewReader(get(url.Values{"sid": {sid}})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, it := range master.Items {
+		if pi, ok := it.(*m3u8.PlaylistItem); ok {
+			got = append(got, fmt.Sprintf("%d %s %s", pi.Bandwidth, *pi.Codecs, pi.URI))
+		}
+	}
+	want := []string{
+		"128000 mp4a.40.2 /m3u8?" + url.Values{"sid": {sid}, "variant": {"128000"}}.Encode(),
+		"48000 mp4a.40.5 /m3u8?" + url.Values{"sid": {sid}, "variant": {"48000"}}.Encode(),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want variants %v, got %v", want, got)
+	}
+
+	// both variants play the same time, under the same sequences.
+	body := get(url.Values{"sid": {sid}, "variant": {"128000"}})
+	if !strings.Contains(body, "#EXT-X-MEDIA-SEQUENCE:10") || !strings.Contains(body, chunkURL(hi.ID, "hi-10.ts")) {
+		t.Errorf("want high variant from chunk 10:\n%s", body)
+	}
+	body = get(url.Values{"sid": {sid}, "variant": {"48000"}})
+	if !strings.Contains(body, "#EXT-X-MEDIA-SEQUENCE:10") || !strings.Contains(body, chunkURL(lo.ID, "lo-10.ts")) {
+		t.Errorf("want low variant from chunk 10:\n%s", body)
+	}
+
+	rec := httptest.NewRecorder()
+	pl.ServePlaylist(rec, httptest.NewRequest("GET", "/m3u8?"+url.Values{"sid": {sid}, "variant": {"1"}}.Encode(), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("want 404 for an unknown variant, got %d", rec.Code)
+	}
+}
+
+func TestVariantPrimary(t *testing.T) {
+	idx := newChunkIndex()
+	hi, lo := newStreamVariant("s", 128000, 0, ""), newStreamVariant("s", 48000, 0, "")
+	idx.Append(hi.ID, recordedChunk{Sequence: 1, ChunkID: "hi.ts"})
+	idx.Append(lo.ID, recordedChunk{Sequence: 1, ChunkID: "lo.ts"})
+
+	idx.SetVariants("s", []streamVariant{lo, hi})
+	if rc, ok := idx.GetChunk("s", "hi.ts"); !ok || rc.ChunkID != "hi.ts" {
+		t.Error("want the stream to read from the highest bandwidth variant")
+	}
+
+	// a higher variant turning up doesn't move it
+	idx.SetVariants("s", []streamVariant{lo, hi, newStreamVariant("s", 256000, 0, "")})
+	if _, ok := idx.GetChunk("s", "hi.ts"); !ok {
+		t.Error("want the primary variant pinned")
+	}
+
+	// but losing it does
+	idx.SetVariants("s", []streamVariant{lo})
+	if _, ok := idx.GetChunk("s", "lo.ts"); !ok {
+		t.Error("want the primary variant to move when it's no longer recorded")
+	}
+}
+
+func TestVariantsReadRecordedBefore(t *testing.T) {
+	ctx := context.Background()
+	t0 := time.Date(2026, 4, 7, 0, 0, 0, 0, time.UTC)
+	idx := newChunkIndex()
+	// recorded before variants were turned on
+	for i := range 3 {
+		idx.Append("s", recordedChunk{Sequence: i + 1, ChunkID: fmt.Sprintf("old-%d.ts", i+1), Duration: 10, FetchedAt: t0.Add(time.Duration(i) * 10 * time.Second)})
+	}
+	hi, lo := newStreamVariant("s", 128000, 0, ""), newStreamVariant("s", 48000, 0, "")
+	if n := idx.NextSequence(hi.ID); n != 4 {
+		t.Errorf("want a new variant to carry on from the stream at 4, got %d", n)
+	}
+	for _, v := range []streamVariant{hi, lo} {
+		idx.Append(v.ID, recordedChunk{Sequence: 4, ChunkID: v.Name + "-4.ts", Duration: 10, FetchedAt: t0.Add(30 * time.Second)})
+	}
+	idx.SetVariants("s", []streamVariant{hi, lo})
+
+	cs, err := idx.Chunks(ctx, "s", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range cs {
+		got = append(got, fmt.Sprintf("%s:%d:%t", c.ChunkID, c.Sequence, c.Discontinuity))
+	}
+	if want := "[old-1.ts:1:false old-2.ts:2:false old-3.ts:3:false 128000-4.ts:4:true]"; fmt.Sprint(got) != want {
+		t.Errorf("want the old chunks ahead of the primary variant %s, got %v", want, got)
+	}
+	if rc, ok := idx.ChunkAt(lo.ID, t0.Add(10*time.Second), time.Second); !ok || rc.ChunkID != "old-2.ts" {
+		t.Errorf("want the other variants lined up with the old chunks too, got %v", rc)
+	}
+	if _, ok := idx.GetChunk(lo.ID, "old-1.ts"); !ok {
+		t.Error("want old chunks served through a variant")
+	}
+}
+
+func TestIndexStoredVariants(t *testing.T) {
+	t0 := time.Date(2026, 4, 7, 0, 0, 0, 0, time.UTC)
+	objs := []storedObject{
+		{Key: encodeObjectKey("s", t0, 10, 1, 0, "a.ts")},
+		{Key: encodeObjectKey("s/128000", t0, 10, 5, 0, "hi.ts")},
+		{Key: encodeObjectKey("s/48000", t0, 10, 7, 0, "lo.ts")},
+		{Key: encodeObjectKey("s/48000-2", t0, 10, 7, 0, "lo-he.ts")},
+		{Key: encodeObjectKey("sx", t0, 10, 1, 0, "other.ts")},
+	}
+	idx := newChunkIndex()
+	indexStoredObjects(idx, "s", objs)
+
+	if subs := idx.SubStreams("s"); fmt.Sprint(subs) != "[s/128000 s/48000 s/48000-2]" {
+		t.Errorf("want every variant indexed, got %v", subs)
+	}
+	if rc, ok := idx.GetChunk("s/48000", "lo.ts"); !ok || rc.Sequence != 7 {
+		t.Errorf("want lo.ts at sequence 7 in its variant, got %v", rc)
+	}
+	if idx.HasLogical("s", "hi.ts") || idx.HasLogical("s", "other.ts") {
+		t.Error("want only the stream's own chunks under it")
+	}
+
+	vs := storedVariants("s", idx.SubStreams("s"))
+	if len(vs) != 3 || vs[0].Bandwidth != 128000 || vs[1].Bandwidth != 48000 || vs[2].Name != "48000-2" || vs[2].Bandwidth != 48000 {
+		t.Errorf("want variants from the stored sub-streams, got %v", vs)
+	}
+}
+
+const testMasterPlaylist = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",LANGUAGE="en-AU",DEFAULT=YES,URI="aac/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="French",LANGUAGE="fr",URI="aac/fr.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=48000,CODECS="mp4a.40.5"
+lo/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS="mp4a.40.2"
+hi/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=96000,CODECS="mp4a.40.2",AUDIO="aac"
+group/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=320000,CODECS="ac-3"
+ac3/index.m3u8
+`
+
+func TestVariantConfig(t *testing.T) {
+	pl, err := m3u8.Read(strings.NewReader(testMasterPlaylist))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name string
+		Cfg  variantConfig
+		Want string
+	}{
+		{
+			Name: "Max bandwidth",
+			Cfg:  variantConfig{Select: variantSelectMaxBandwidth},
+			Want: "ac3/index.m3u8",
+		},
+		{
+			Name: "Min bandwidth",
+			Cfg:  variantConfig{Select: variantSelectMinBandwidth},
+			Want: "lo/index.m3u8",
+		},
+		{
+			Name: "Codec",
+			Cfg:  variantConfig{Select: variantSelectMaxBandwidth, Codecs: "mp4a.40"},
+			Want: "hi/index.m3u8",
+		},
+		{
+			Name: "URI",
+			Cfg:  variantConfig{Select: variantSelectMaxBandwidth, uri: regexp.MustCompile("^lo/")},
+			Want: "lo/index.m3u8",
+		},
+		{
+			Name: "Audio group default rendition",
+			Cfg:  variantConfig{Select: variantSelectMaxBandwidth, AudioGroup: "aac"},
+			Want: "aac/en.m3u8",
+		},
+		{
+			Name: "Language",
+			Cfg:  variantConfig{Select: variantSelectMaxBandwidth, Language: "fr"},
+			Want: "aac/fr.m3u8",
+		},
+		{
+			Name: "Language ignores region",
+			Cfg:  variantConfig{Select: variantSelectMaxBandwidth, Language: "en"},
+			Want: "aac/en.m3u8",
+		},
+		{
+			Name: "Nothing matches",
+			Cfg:  variantConfig{Select: variantSelectMaxBandwidth, Language: "de"},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			v, ok := tc.Cfg.pick(tc.Cfg.match(pl))
+			if !ok {
+				if tc.Want != "" {
+					t.Fatal("want a variant")
+				}
+				return
+			}
+			if got := v.PlaylistURI(); got != tc.Want {
+				t.Errorf("want %s, got %s", tc.Want, got)
+			}
+		})
+	}
+}
+
+func TestFetcherPinsVariant(t *testing.T) {
+	read := func(s string) []sourceVariant {
+		t.Helper()
+		pl, err := m3u8.Read(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return variantConfig{Select: variantSelectMaxBandwidth}.match(pl)
+	}
+	idx := newChunkIndex()
+	fs, err := newFSChunkStore(t.TempDir(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := newStationChunkStore("s", fs, idx)
+	f := &fetcher{l: logrus.New(), cs: cs, variantCfg: variantConfig{Select: variantSelectMaxBandwidth}, rec: &recording{lastSeq: 10}}
+
+	v, _ := f.pinVariant(read("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=128000\nhi.m3u8?token=1\n#EXT-X-STREAM-INF:BANDWIDTH=48000\nlo.m3u8?token=1\n"))
+	if v.Bandwidth != 128000 {
+		t.Fatalf("want 128000 picked, got %s", v)
+	}
+
+	// reshuffled with a new best variant and new tokens, we keep recording
+	// the same one.
+	v, _ = f.pinVariant(read("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=48000\nlo.m3u8?token=2\n#EXT-X-STREAM-INF:BANDWIDTH=320000\nbest.m3u8?token=2\n#EXT-X-STREAM-INF:BANDWIDTH=128000\nhi.m3u8?token=2\n"))
+	if v.Bandwidth != 128000 || v.URI != "hi.m3u8?token=2" {
+		t.Errorf("want to stay on 128000, got %s %s", v, v.URI)
+	}
+	if f.rec.lastSeq != 10 {
+		t.Error("staying on the variant shouldn't mark a discontinuity")
+	}
+
+	// only moving once it's gone
+	v, _ = f.pinVariant(read("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=48000\nlo.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=320000\nbest.m3u8\n"))
+	if v.Bandwidth != 320000 {
+		t.Errorf("want to move to 320000, got %s", v)
+	}
+	if f.rec.lastSeq != -1 {
+		t.Error("want the switch to start a new run of segments")
+	}
+
+	// and a restart picks up where it left off, rather than picking again
+	f = &fetcher{l: logrus.New(), cs: cs, variantCfg: variantConfig{Select: variantSelectMaxBandwidth}, rec: &recording{lastSeq: 10}}
+	v, _ = f.pinVariant(read("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=48000\nlo.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=640000\nbester.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=320000\nbest.m3u8\n"))
+	if v.Bandwidth != 320000 {
+		t.Errorf("want to stay on 320000 after a restart, got %s", v)
+	}
+
+	// a pin that can't be read isn't replaced by a fresh pick
+	broken := newStationChunkStore("s", failingGetStore{fs}, idx)
+	f = &fetcher{l: logrus.New(), cs: broken, variantCfg: variantConfig{Select: variantSelectMaxBandwidth}, rec: &recording{lastSeq: 10}}
+	if _, err := f.pinVariant(read("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=640000\nbester.m3u8\n")); err == nil {
+		t.Error("want an error reading the pin")
+	}
+	if got, err := cs.PinnedVariant(context.Background()); err != nil || !strings.Contains(got, "320000") {
+		t.Errorf("want the pin left on 320000, got %q %v", got, err)
+	}
+}
+
+// failingGetStore is a store whose objects can't be read.
+type failingGetStore struct {
+	*fsChunkStore
+}
+
+func (failingGetStore) GetObject(context.Context, string) ([]byte, error) {
+	return nil, errors.New("unavailable")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/etherlabsio/go-m3u8/m3u8"
+)
+
+// ServeVOD serves a complete VOD playlist covering ?stream=&from=&to=, so a
+// listener can seek freely within a past time range. from and to take the same
+// formats as ?at=, in ?tz= if given or the stream's base timezone otherwise.
+func (p *playlist) ServeVOD(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	streamID := q.Get("stream")
+	if streamID == "" {
+		http.Error(w, "stream, from and to must be present on query", http.StatusBadRequest)
+		return
+	}
+	st, ok := findStream(p.streams, streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+
+	rcs, err := retainedRange(p.indexer, st, q, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pl := m3u8.Playlist{
+		Sequence: rcs[0].Sequence,
+		Version:  new(4),
+		Target:   maxDuration(rcs),
+		Type:     new("VOD"),
+		Live:     false,
+	}
+	// counted from the start of what's held, like the live playlists
+	if n := len(p.indexer.DiscontinuitiesBetween(streamID, 0, rcs[0].Sequence)); n > 0 {
+		pl.DiscontinuitySequence = new(n)
+	}
+	for _, rc := range rcs {
+		if rc.Discontinuity {
+			pl.AppendItem(&m3u8.DiscontinuityItem{})
+		}
+		pl.AppendItem(&m3u8.SegmentItem{
+			Segment:  chunkURL(streamID, rc.ChunkID),
+			Duration: rc.Duration,
+		})
+	}
+
+	w.Header().Set("content-type", "application/x-mpegURL")
+	fmt.Fprint(w, pl.String())
+}
+
+// retainedRange parses ?from=&to= for a stream, and returns the chunks covering
+// it. It is an error for any of the range to be outside what is retained.
+func retainedRange(idx *chunkIndex, st configStream, q url.Values, now time.Time) ([]recordedChunk, error) {
+	from, to, err := parseTimeRange(q, st, now)
+	if err != nil {
+		return nil, err
+	}
+	oldest, newest, ok := idx.Span(st.ID)
+	if !ok {
+		return nil, fmt.Errorf("nothing recorded for %s", st.ID)
+	}
+	if from.Before(oldest) {
+		return nil, fmt.Errorf("range starts at %s, before the oldest retained audio at %s", from.Format(time.RFC3339), oldest.Format(time.RFC3339))
+	}
+	if to.After(newest) {
+		return nil, fmt.Errorf("range ends at %s, after the newest recorded audio at %s", to.Format(time.RFC3339), newest.Format(time.RFC3339))
+	}
+	rcs := idx.ChunksBetween(st.ID, from, to)
+	if len(rcs) == 0 {
+		return nil, fmt.Errorf("no audio recorded between %s and %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+	return rcs, nil
+}
+
+// parseTimeRange parses ?from=&to= as listener times, see parseListenerTime.
+func parseTimeRange(q url.Values, st configStream, now time.Time) (from, to time.Time, err error) {
+	fq, tq := q.Get("from"), q.Get("to")
+	if fq == "" || tq == "" {
+		return time.Time{}, time.Time{}, errors.New("from and to must be present on query")
+	}
+	zone := q.Get("tz")
+	if zone == "" {
+		zone = st.BaseTimezone
+	}
+	loc, err := loadListenerLocation(zone)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("finding timezone %s: %v", zone, err)
+	}
+	from, err = parseListenerTime(fq, loc, now)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("from: %v", err)
+	}
+	to, err = parseListenerTime(tq, loc, now)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("to: %v", err)
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("to %s must be after from %s", tq, fq)
+	}
+	return from, to, nil
+}
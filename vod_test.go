@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestServeVOD(t *testing.T) {
+	ctx := context.Background()
+	idx := newChunkIndex()
+	t0 := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	for i := range 30 {
+		if err := idx.RecordChunk(ctx, "s", fmt.Sprintf("chunk-%d.ts", i+1), 10, t0.Add(time.Duration(i)*10*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	streams := []configStream{{ID: "s", BaseTimezone: "UTC"}}
+	pl := newPlaylist(logrus.New(), streams, idx, nil, newHLSSessions())
+
+	get := func(from, to string) *httptest.ResponseRecorder {
+		q := url.Values{"stream": {"s"}, "from": {from}, "to": {to}}
+		rec := httptest.NewRecorder()
+		pl.ServeVOD(rec, httptest.NewRequest("GET", "/vod?"+q.Encode(), nil))
+		return rec
+	}
+
+	rec := get("2026-01-15T00:01:05Z", "2026-01-15T00:02:00Z")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"#EXT-X-PLAYLIST-TYPE:VOD",
+		"#EXT-X-MEDIA-SEQUENCE:7",
+		"#EXT-X-ENDLIST",
+		chunkURL("s", "chunk-7.ts"),
+		chunkURL("s", "chunk-12.ts"),
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("playlist should contain %s:\n%s", want, body)
+		}
+	}
+	for _, notWant := range []string{chunkURL("s", "chunk-6.ts"), chunkURL("s", "chunk-13.ts")} {
+		if strings.Contains(body, notWant) {
+			t.Errorf("playlist should not contain %s:\n%s", notWant, body)
+		}
+	}
+
+	for _, tc := range []struct{ from, to, want string }{
+		{"2026-01-14T23:00:00Z", "2026-01-15T00:01:00Z", "before the oldest retained"},
+		{"2026-01-15T00:01:00Z", "2026-01-15T01:00:00Z", "after the newest recorded"},
+		{"2026-01-15T00:02:00Z", "2026-01-15T00:01:00Z", "must be after"},
+	} {
+		rec := get(tc.from, tc.to)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tc.want) {
+			t.Errorf("%s-%s: want 400 %q, got %d %s", tc.from, tc.to, tc.want, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestServeVODGaps(t *testing.T) {
+	idx := newChunkIndex()
+	t0 := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	for i := range 10 {
+		at := t0.Add(time.Duration(i) * 10 * time.Second)
+		if i >= 6 {
+			// down for a minute before chunk 7
+			at = at.Add(time.Minute)
+		}
+		idx.Append("s", recordedChunk{
+			Sequence:      i + 1,
+			ChunkID:       fmt.Sprintf("chunk-%d.ts", i+1),
+			Duration:      10,
+			FetchedAt:     at,
+			Discontinuity: i+1 == 2 || i+1 == 7,
+		})
+	}
+	streams := []configStream{{ID: "s", BaseTimezone: "UTC"}}
+	pl := newPlaylist(logrus.New(), streams, idx, nil, newHLSSessions())
+
+	q := url.Values{"stream": {"s"}, "from": {"2026-01-15T00:00:30Z"}, "to": {"2026-01-15T00:02:30Z"}}
+	rec := httptest.NewRecorder()
+	pl.ServeVOD(rec, httptest.NewRequest("GET", "/vod?"+q.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "#EXT-X-DISCONTINUITY-SEQUENCE:1") {
+		t.Errorf("want the discontinuity before the clip counted:\n%s", body)
+	}
+	disc := strings.Index(body, "#EXT-X-DISCONTINUITY\n")
+	if strings.Count(body, "#EXT-X-DISCONTINUITY\n") != 1 || disc < strings.Index(body, chunkURL("s", "chunk-6.ts")) || disc > strings.Index(body, chunkURL("s", "chunk-7.ts")) {
+		t.Errorf("want one discontinuity, across the gap before chunk 7:\n%s", body)
+	}
+}